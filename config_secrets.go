@@ -0,0 +1,154 @@
+// config_secrets.go - ${ENV_VAR} and file: indirection for config values
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Prefix for values read from a file (systemd LoadCredential, Docker secrets)
+const secretFilePrefix = "file:"
+
+const redactedValue = "[redacted]"
+
+// expandConfigSecrets resolves ${ENV_VAR} references and file: values in
+// every string field of the config, so credentials can stay out of the XML
+func expandConfigSecrets(config *Config) error {
+	return expandStrings(reflect.ValueOf(config).Elem(), "")
+}
+
+func expandStrings(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.String:
+		if !v.CanSet() {
+			return nil
+		}
+		expanded, err := expandConfigValue(v.String())
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		v.SetString(expanded)
+
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if !t.Field(i).IsExported() {
+				continue
+			}
+			if err := expandStrings(v.Field(i), joinConfigPath(path, t.Field(i))); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := expandStrings(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return expandStrings(v.Elem(), path)
+		}
+	}
+
+	return nil
+}
+
+// expandConfigValue replaces ${NAME} with the environment variable NAME,
+// then, if the result starts with "file:", replaces it with the contents of
+// that file (trailing whitespace trimmed). A lone "$" is left alone so
+// passwords containing it keep working.
+func expandConfigValue(value string) (string, error) {
+	if !strings.Contains(value, "${") && !strings.HasPrefix(value, secretFilePrefix) {
+		return value, nil
+	}
+
+	var result strings.Builder
+	rest := value
+	for {
+		start := strings.Index(rest, "${")
+		if start < 0 {
+			result.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in value")
+		}
+
+		name := rest[start+2 : start+end]
+		envValue, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+
+		result.WriteString(rest[:start])
+		result.WriteString(envValue)
+		rest = rest[start+end+1:]
+	}
+
+	expanded := result.String()
+	if strings.HasPrefix(expanded, secretFilePrefix) {
+		path := strings.TrimPrefix(expanded, secretFilePrefix)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file %s: %w", path, err)
+		}
+		expanded = strings.TrimRight(string(data), "\r\n\t ")
+	}
+
+	return expanded, nil
+}
+
+// redactConfig returns a copy of the config with every field tagged
+// secret:"true" masked, safe to return from diagnostic endpoints
+func redactConfig(config Config) Config {
+	redactSecrets(reflect.ValueOf(&config).Elem())
+	return config
+}
+
+func redactSecrets(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if !t.Field(i).IsExported() || !field.CanSet() {
+				continue
+			}
+			if t.Field(i).Tag.Get("secret") == "true" && field.Kind() == reflect.String {
+				if field.String() != "" {
+					field.SetString(redactedValue)
+				}
+				continue
+			}
+			redactSecrets(field)
+		}
+
+	case reflect.Slice:
+		// Copy so the live config is never modified
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		reflect.Copy(copied, v)
+		for i := 0; i < copied.Len(); i++ {
+			redactSecrets(copied.Index(i))
+		}
+		if v.CanSet() {
+			v.Set(copied)
+		}
+	}
+}
+
+func joinConfigPath(path string, field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("xml"), ",")[0]
+	if name == "" {
+		name = field.Name
+	}
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
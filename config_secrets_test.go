@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandConfigValue(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "password")
+	if err := os.WriteFile(secretFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("ENVOY_TEST_PASSWORD", "from-env")
+	t.Setenv("ENVOY_TEST_DIR", dir)
+	t.Setenv("ENVOY_TEST_EMPTY", "")
+
+	tests := []struct {
+		value  string
+		want   string
+		errors bool
+	}{
+		{"plain", "plain", false},
+		{"pa$$word", "pa$$word", false},
+		{"${ENVOY_TEST_PASSWORD}", "from-env", false},
+		{"user-${ENVOY_TEST_PASSWORD}-${ENVOY_TEST_PASSWORD}", "user-from-env-from-env", false},
+		{"x${ENVOY_TEST_EMPTY}y", "xy", false},
+		{"file:" + secretFile, "from-file", false},
+		{"file:${ENVOY_TEST_DIR}/password", "from-file", false},
+		{"${ENVOY_TEST_UNSET}", "", true},
+		{"${ENVOY_TEST_PASSWORD", "", true},
+		{"file:" + filepath.Join(dir, "missing"), "", true},
+	}
+	for _, tt := range tests {
+		got, err := expandConfigValue(tt.value)
+		if (err != nil) != tt.errors {
+			t.Errorf("expandConfigValue(%q) error = %v, want error %v", tt.value, err, tt.errors)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expandConfigValue(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestExpandConfigSecrets(t *testing.T) {
+	t.Setenv("ENVOY_TEST_TOKEN", "tok")
+
+	config := Config{
+		Token: "${ENVOY_TEST_TOKEN}",
+		Gateways: GatewaysConfig{Gateways: []GatewayConfig{
+			{Name: "house", Password: "${ENVOY_TEST_TOKEN}"},
+		}},
+		MQTT: MQTTConfig{Password: "${ENVOY_TEST_TOKEN}"},
+	}
+	if err := expandConfigSecrets(&config); err != nil {
+		t.Fatalf("expandConfigSecrets: %v", err)
+	}
+	if config.Token != "tok" || config.Gateways.Gateways[0].Password != "tok" || config.MQTT.Password != "tok" {
+		t.Errorf("values not expanded: %+v", config)
+	}
+
+	// Errors name the field holding the value
+	config = Config{Gateways: GatewaysConfig{Gateways: []GatewayConfig{{}, {Token: "${ENVOY_TEST_UNSET}"}}}}
+	err := expandConfigSecrets(&config)
+	if err == nil || !strings.HasPrefix(err.Error(), "gateways.gateway[1].token:") {
+		t.Errorf("error = %v, want one naming gateways.gateway[1].token", err)
+	}
+}
+
+func TestRedactConfig(t *testing.T) {
+	config := Config{
+		User:     "owner@example.com",
+		Password: "secret",
+		Token:    "tok",
+		Cloud:    CloudConfig{Proxy: "http://user:pw@proxy:3128"},
+		Gateways: GatewaysConfig{Gateways: []GatewayConfig{
+			{Name: "house", Token: "house-token"},
+		}},
+		AuthModules: AuthModules{Modules: []AuthModule{
+			{Name: "site_b", DigestPassword: "digest"},
+		}},
+		MQTT: MQTTConfig{Username: "mqtt", Password: "mqtt-secret"},
+	}
+
+	redacted := redactConfig(config)
+
+	tests := []struct {
+		field string
+		got   string
+		want  string
+	}{
+		{"user", redacted.User, "owner@example.com"},
+		{"password", redacted.Password, redactedValue},
+		{"token", redacted.Token, redactedValue},
+		{"digest_password", redacted.DigestPassword, ""},
+		{"cloud.proxy", redacted.Cloud.Proxy, redactedValue},
+		{"gateway name", redacted.Gateways.Gateways[0].Name, "house"},
+		{"gateway token", redacted.Gateways.Gateways[0].Token, redactedValue},
+		{"auth module digest_password", redacted.AuthModules.Modules[0].DigestPassword, redactedValue},
+		{"mqtt username", redacted.MQTT.Username, "mqtt"},
+		{"mqtt password", redacted.MQTT.Password, redactedValue},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.field, tt.got, tt.want)
+		}
+	}
+
+	// The live config, including its slices, is left untouched
+	if config.Password != "secret" || config.Gateways.Gateways[0].Token != "house-token" || config.AuthModules.Modules[0].DigestPassword != "digest" {
+		t.Errorf("redactConfig modified its input: %+v", config)
+	}
+}
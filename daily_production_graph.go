@@ -48,12 +48,12 @@ type ProductionTracker struct {
 }
 
 // Initialize production tracking
-func (e *EnvoyExporter) initProductionTracking() {
-	if e.productionTracker != nil {
+func (g *Gateway) initProductionTracking() {
+	if g.productionTracker != nil {
 		return
 	}
 
-	dataFile := filepath.Join(e.config.WebDir, "production_history.json")
+	dataFile := filepath.Join(g.config.WebDir, g.stateFileName("production_history.json"))
 	
 	tracker := &ProductionTracker{
 		dataFile: dataFile,
@@ -67,9 +67,9 @@ func (e *EnvoyExporter) initProductionTracking() {
 	tracker.loadHistory()
 
 	// Start tracking goroutine
-	go tracker.trackingLoop(e)
+	go tracker.trackingLoop(g)
 
-	e.productionTracker = tracker
+	g.productionTracker = tracker
 	LogInfo("Production tracking initialized with data file: %s", dataFile)
 }
 
@@ -156,7 +156,7 @@ func (pt *ProductionTracker) saveHistory() {
 }
 
 // FIXED: More robust tracking loop with better error handling
-func (pt *ProductionTracker) trackingLoop(exporter *EnvoyExporter) {
+func (pt *ProductionTracker) trackingLoop(gateway *Gateway) {
 	LogInfo("Starting production tracking loop...")
 	
 	ticker := time.NewTicker(5 * time.Minute) // Sample every 5 minutes
@@ -176,7 +176,7 @@ func (pt *ProductionTracker) trackingLoop(exporter *EnvoyExporter) {
 		select {
 		case <-ticker.C:
 			LogInfo("Recording current production...")
-			pt.recordCurrentProduction(exporter)
+			pt.recordCurrentProduction(gateway)
 
 		case <-saveTicker.C:
 			LogInfo("Save ticker triggered...")
@@ -200,7 +200,7 @@ func (pt *ProductionTracker) trackingLoop(exporter *EnvoyExporter) {
 }
 
 // FIXED: Better error handling and logging
-func (pt *ProductionTracker) recordCurrentProduction(exporter *EnvoyExporter) {
+func (pt *ProductionTracker) recordCurrentProduction(gateway *Gateway) {
 	now := time.Now()
 	dateStr := now.Format("2006-01-02")
 	hour := now.Hour()
@@ -208,9 +208,7 @@ func (pt *ProductionTracker) recordCurrentProduction(exporter *EnvoyExporter) {
 	LogInfo("Recording production for %s hour %d", dateStr, hour)
 
 	// Get current monitor data
-	exporter.monitorMutex.RLock()
-	monitorData := exporter.lastMonitorData
-	exporter.monitorMutex.RUnlock()
+	monitorData := gateway.currentSnapshot().Monitor
 
 	if monitorData.Production.CurrentWatts == 0 && monitorData.Production.TodayWh == 0 {
 		LogInfo("No production data available, skipping recording")
@@ -314,7 +312,12 @@ func (e *EnvoyExporter) serveDailyProductionAPI(w http.ResponseWriter, r *http.R
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	if e.productionTracker == nil {
+	g, ok := e.requestGateway(w, r)
+	if !ok {
+		return
+	}
+
+	if g.productionTracker == nil {
 		http.Error(w, "Production tracking not initialized", http.StatusServiceUnavailable)
 		return
 	}
@@ -332,11 +335,12 @@ func (e *EnvoyExporter) serveDailyProductionAPI(w http.ResponseWriter, r *http.R
 		previousDate = yesterday.Format("2006-01-02")
 	}
 
-	pt := e.productionTracker
+	pt := g.productionTracker
 	pt.history.mutex.RLock()
 	defer pt.history.mutex.RUnlock()
 
 	response := map[string]interface{}{
+		"gateway": g.name,
 		"date": dateStr,
 		"previous_date": previousDate,
 		"current_day": pt.history.Days[dateStr],
@@ -374,9 +378,11 @@ func formatProductionForAPI(day *DailyProduction) map[string]interface{} {
 
 // FIXED: Add method to manually trigger save (useful for testing)
 func (e *EnvoyExporter) ForceSaveProductionHistory() {
-	if e.productionTracker != nil {
-		LogInfo("Force saving production history...")
-		e.productionTracker.dataChanged = true
-		e.productionTracker.saveHistory()
+	for _, g := range e.gateways {
+		if g.productionTracker != nil {
+			LogInfo("Force saving production history for gateway %s...", g.name)
+			g.productionTracker.dataChanged = true
+			g.productionTracker.saveHistory()
+		}
 	}
 }
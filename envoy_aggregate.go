@@ -0,0 +1,151 @@
+// envoy_aggregate.go - Metrics summarising the items of an array
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A metric with an aggregate attribute reduces the series its items produce
+// instead of exposing them: count, sum, avg, min or max per distinct label
+// set, so its label fields are the group-by. A filter attribute, a JSONPath
+// filter expression such as "@.communicating == false", selects the items.
+//
+//	<metric name="envoy_inverters" aggregate="count">
+//	    <field json_path="devType" label="dev_type"/>
+//	</metric>
+//
+// count counts items whether or not they have a value field. With no item
+// left, count and sum report 0 unless the metric groups by a path label.
+var aggregateFunctions = []string{"count", "sum", "avg", "min", "max"}
+
+// itemFilter compiles a filter expression, reusing the JSONPath filter syntax
+func itemFilter(filter string) (*pathFilter, error) {
+	steps, err := compileJSONPath("$[?(" + filter + ")]")
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %q: %w", filter, err)
+	}
+	if len(steps) != 1 || steps[0].kind != stepFilter {
+		return nil, fmt.Errorf("invalid filter %q", filter)
+	}
+	return steps[0].filter, nil
+}
+
+// validateAggregates checks aggregate functions and filters
+func validateAggregates(queries []Query) error {
+	for _, query := range queries {
+		for _, metric := range query.Metrics {
+			if metric.Aggregate != "" && !containsLabel(aggregateFunctions, metric.Aggregate) {
+				return fmt.Errorf("query %s, metric %s: unknown aggregate %q (%s)",
+					query.Name, metric.Name, metric.Aggregate, strings.Join(aggregateFunctions, ", "))
+			}
+			if metric.Filter != "" {
+				if _, err := itemFilter(metric.Filter); err != nil {
+					return fmt.Errorf("query %s, metric %s: %w", query.Name, metric.Name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// collectMetric adds a metric's series for the query items, expanding the
+// metric's array_path and reducing them when it aggregates
+func (g *Gateway) collectMetric(metric Metric, items []jsonPathMatch, set *metricSet) {
+	if metric.ArrayPath != "" {
+		var expanded []jsonPathMatch
+		for _, item := range items {
+			expanded = append(expanded, g.arrayItems(item, metric.ArrayPath)...)
+		}
+		items = expanded
+	}
+
+	if metric.Filter != "" {
+		filter, err := itemFilter(metric.Filter)
+		if err != nil {
+			LogDebug("Metric %s: %v", metric.Name, err)
+			return
+		}
+		selected := items[:0:0]
+		for _, item := range items {
+			if filter.matches(item.Value) {
+				selected = append(selected, item)
+			}
+		}
+		items = selected
+	}
+
+	if metric.Aggregate == "" {
+		for _, item := range items {
+			g.processMetric(metric, item, set)
+		}
+		return
+	}
+
+	// Every item counts, with or without a value
+	if metric.Aggregate == "count" {
+		var labelFields []Field
+		for _, field := range metric.Fields {
+			if field.Label != "" {
+				labelFields = append(labelFields, field)
+			}
+		}
+		metric.Fields = labelFields
+		metric.Value = "1"
+	}
+
+	series := &metricSet{}
+	for _, item := range items {
+		g.processMetric(metric, item, series)
+	}
+
+	vector := make(exprVector, 0, len(series.samples))
+	for _, sample := range series.samples {
+		vector = append(vector, exprSeries{Labels: sample.Labels, Value: sample.Value})
+	}
+	reduced, err := aggregate(vector, &labelGrouping{without: true}, exprFunctions[metric.Aggregate].aggregate)
+	if err != nil {
+		LogDebug("Metric %s: %v", metric.Name, err)
+		return
+	}
+	groups, ok := reduced.(exprVector)
+	if !ok {
+		LogDebug("Metric %s: %s did not produce a vector", metric.Name, metric.Aggregate)
+		return
+	}
+
+	if len(groups) == 0 && (metric.Aggregate == "count" || metric.Aggregate == "sum") && !groupsByPath(metric) {
+		labels := g.labels()
+		for _, field := range metric.Fields {
+			if field.Label != "" {
+				labels[field.Label] = field.LabelValue
+			}
+		}
+		groups = exprVector{{Labels: labels, Value: 0}}
+	}
+
+	for _, group := range groups {
+		set.add(metric.Name, metric.Type, metric.Help, group.Labels, group.Value)
+	}
+}
+
+// groupsByPath reports whether a metric has labels read from its items
+func groupsByPath(metric Metric) bool {
+	for _, field := range metric.Fields {
+		if field.Label != "" && field.LabelValue == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// aggregateItems returns the single value of an aggregate metric without
+// group-by labels
+func (g *Gateway) aggregateItems(metric Metric, items []jsonPathMatch) float64 {
+	set := &metricSet{}
+	g.collectMetric(metric, items, set)
+	if len(set.samples) == 0 {
+		return 0
+	}
+	return set.samples[0].Value
+}
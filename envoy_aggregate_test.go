@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testInverters = `[
+	{"serialNumber": "A1", "devType": 1, "lastReportWatts": 200, "producing": true},
+	{"serialNumber": "A2", "devType": 1, "lastReportWatts": 0, "producing": false},
+	{"serialNumber": "B1", "devType": 2, "lastReportWatts": 50, "producing": true},
+	{"serialNumber": "B2", "devType": 2, "producing": true}
+]`
+
+// formatSamples renders samples as sorted "labels value" lines
+func formatSamples(samples []metricSample) string {
+	var lines []string
+	for _, sample := range samples {
+		var labels []string
+		for name, value := range sample.Labels {
+			if name != "gateway" {
+				labels = append(labels, name+"="+value)
+			}
+		}
+		sort.Strings(labels)
+		lines = append(lines, fmt.Sprintf("{%s} %g", strings.Join(labels, ","), sample.Value))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, " ")
+}
+
+func TestCollectMetricAggregates(t *testing.T) {
+	value := Field{JSONPath: "lastReportWatts"}
+	byType := Field{JSONPath: "devType", Label: "dev_type"}
+	site := Field{Label: "site", LabelValue: "house"}
+
+	tests := []struct {
+		name   string
+		metric Metric
+		want   string
+	}{
+		{"count", Metric{Aggregate: "count"}, "{} 4"},
+		{"count ignores the value field", Metric{Aggregate: "count", Fields: []Field{value}}, "{} 4"},
+		{"count by label", Metric{Aggregate: "count", Fields: []Field{byType}}, "{dev_type=1} 2 {dev_type=2} 2"},
+		{"count with filter", Metric{Aggregate: "count", Filter: "@.lastReportWatts > 0"}, "{} 2"},
+		{"count with grouped filter", Metric{Aggregate: "count", Filter: "(@.devType == 1 || @.devType == 2) && @.producing == false"}, "{} 1"},
+		{"count of nothing", Metric{Aggregate: "count", Filter: "@.devType == 9", Fields: []Field{site}}, "{site=house} 0"},
+		{"count of nothing by path", Metric{Aggregate: "count", Filter: "@.devType == 9", Fields: []Field{byType}}, ""},
+		{"sum skips missing values", Metric{Aggregate: "sum", Fields: []Field{value}}, "{} 250"},
+		{"sum by label", Metric{Aggregate: "sum", Fields: []Field{byType, value}}, "{dev_type=1} 200 {dev_type=2} 50"},
+		{"avg", Metric{Aggregate: "avg", Fields: []Field{value}}, "{} 83.33333333333333"},
+		{"min", Metric{Aggregate: "min", Fields: []Field{value}}, "{} 0"},
+		{"max by label", Metric{Aggregate: "max", Fields: []Field{byType, value}}, "{dev_type=1} 200 {dev_type=2} 50"},
+		{"max of nothing", Metric{Aggregate: "max", Filter: "@.devType == 9", Fields: []Field{value}}, ""},
+		{"filter without aggregate", Metric{Filter: "@.devType == 2", Fields: []Field{{JSONPath: "serialNumber", Label: "serial"}, value}}, "{serial=B1} 50"},
+	}
+
+	items, err := evaluateJSONPath(testDocument(t, testInverters), "$[*]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Gateway{name: "house"}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.metric.Name = "m"
+			set := &metricSet{}
+			g.collectMetric(tt.metric, items, set)
+			if got := formatSamples(set.samples); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateAggregates(t *testing.T) {
+	tests := []struct {
+		metric Metric
+		errors bool
+	}{
+		{Metric{Aggregate: "count"}, false},
+		{Metric{Aggregate: "median"}, true},
+		{Metric{Filter: "@.a == 1"}, false},
+		{Metric{Filter: "a == 1"}, true},
+		{Metric{Filter: "(@.a == 1"}, true},
+	}
+	for _, tt := range tests {
+		err := validateAggregates([]Query{{Name: "q", Metrics: []Metric{tt.metric}}})
+		if (err != nil) != tt.errors {
+			t.Errorf("validateAggregates(%+v) = %v, want error %v", tt.metric, err, tt.errors)
+		}
+	}
+}
@@ -0,0 +1,559 @@
+// envoy_auth.go - Envoy token acquisition and renewal
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token sources
+const (
+	tokenSourceConfig = "config" // inline <token> in the config file
+	tokenSourceFile   = "file"   // <token_file> path
+	tokenSourceEnv    = "env"    // environment variable named by <token_env>
+	tokenSourceCloud  = "cloud"  // Enlighten login + entrez token request
+)
+
+// How often the token file is checked for rotation
+const tokenFileCheckInterval = 30 * time.Second
+
+// Tokens are renewed this long before they expire
+const tokenRefreshWindow = 1 * time.Hour
+
+// Backoff and circuit breaker settings for token refresh attempts
+const (
+	refreshBackoffBase       = 30 * time.Second
+	refreshBackoffMax        = 30 * time.Minute
+	refreshCircuitThreshold  = 5 // consecutive failures before the circuit opens
+	refreshCircuitOpenPeriod = 1 * time.Hour
+)
+
+// A token the gateway refused is not reloaded for this long, unless the
+// gateway accepts it again in the meantime (e.g. after a reboot)
+const tokenRejectionPeriod = 15 * time.Minute
+
+// errEnvoyUnauthorized is returned when the gateway rejects our credentials
+var errEnvoyUnauthorized = errors.New("authentication failed (401)")
+
+func isUnauthorized(err error) bool {
+	return errors.Is(err, errEnvoyUnauthorized)
+}
+
+// tokenRefreshState coalesces concurrent token refreshes into a single
+// attempt and throttles repeated failures
+type tokenRefreshState struct {
+	mutex         sync.Mutex
+	inflight      *tokenRefreshCall
+	failures      int
+	nextAttempt   time.Time
+	lastError     string
+	rejectedToken string // last token the gateway refused
+	rejectedAt    time.Time
+}
+
+type tokenRefreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+// reauthenticate replaces a token the gateway rejected. Concurrent callers
+// share a single refresh; callers holding an already replaced token return
+// immediately. The caller stops waiting when ctx is done.
+func (g *Gateway) reauthenticate(ctx context.Context, staleToken string) error {
+	return g.coalescedRefresh(ctx, staleToken, true)
+}
+
+// coalescedRefresh runs renewToken at most once at a time, applying
+// exponential backoff between failed attempts and opening the circuit after
+// refreshCircuitThreshold consecutive failures. The refresh runs in the
+// background, so a caller whose ctx is done returns early without abandoning
+// it for the others.
+func (g *Gateway) coalescedRefresh(ctx context.Context, staleToken string, rejected bool) error {
+	r := &g.refresh
+
+	r.mutex.Lock()
+	if current := g.getToken(); current != "" && current != staleToken {
+		r.mutex.Unlock()
+		return nil
+	}
+	call := r.inflight
+	if call == nil {
+		if wait := time.Until(r.nextAttempt); wait > 0 {
+			err := fmt.Errorf("token refresh suspended for %s after %d failures (last error: %s)",
+				wait.Round(time.Second), r.failures, r.lastError)
+			r.mutex.Unlock()
+			return err
+		}
+		if rejected {
+			r.rejectedToken = staleToken
+			r.rejectedAt = time.Now()
+		}
+		call = &tokenRefreshCall{done: make(chan struct{})}
+		r.inflight = call
+		go g.runRefresh(call)
+	}
+	r.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for token refresh: %w", ctx.Err())
+	}
+}
+
+// runRefresh performs the refresh started by coalescedRefresh and records
+// its outcome for the backoff
+func (g *Gateway) runRefresh(call *tokenRefreshCall) {
+	r := &g.refresh
+	call.err = g.renewToken()
+
+	r.mutex.Lock()
+	r.inflight = nil
+	if call.err != nil {
+		r.failures++
+		r.lastError = call.err.Error()
+		backoff := refreshBackoffMax
+		if r.failures >= refreshCircuitThreshold {
+			backoff = refreshCircuitOpenPeriod
+			LogError("Token refresh failed %d times in a row, pausing refresh attempts for %s", r.failures, backoff)
+		} else if shift := r.failures - 1; shift < 16 && refreshBackoffBase<<shift < refreshBackoffMax {
+			backoff = refreshBackoffBase << shift
+		}
+		r.nextAttempt = time.Now().Add(backoff)
+	} else {
+		r.failures = 0
+		r.lastError = ""
+		r.nextAttempt = time.Time{}
+	}
+	r.mutex.Unlock()
+	close(call.done)
+}
+
+// isRejectedToken reports whether the gateway refused this token within
+// tokenRejectionPeriod
+func (g *Gateway) isRejectedToken(token string) bool {
+	g.refresh.mutex.Lock()
+	defer g.refresh.mutex.Unlock()
+	return token != "" && token == g.refresh.rejectedToken &&
+		time.Since(g.refresh.rejectedAt) < tokenRejectionPeriod
+}
+
+// tokenAccepted clears the rejection of a token the gateway accepted again,
+// through check_jwt or a successful request, and with it the refresh backoff
+func (g *Gateway) tokenAccepted(token string) {
+	r := &g.refresh
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if token == "" || token != r.rejectedToken {
+		return
+	}
+	r.rejectedToken = ""
+	r.rejectedAt = time.Time{}
+	r.failures = 0
+	r.lastError = ""
+	r.nextAttempt = time.Time{}
+	LogInfo("Gateway %s: previously rejected token accepted again", g.name)
+}
+
+// refreshStatus summarises the refresh backoff state for /health
+func (g *Gateway) refreshStatus() map[string]interface{} {
+	r := &g.refresh
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	circuit := "closed"
+	if r.failures >= refreshCircuitThreshold && time.Now().Before(r.nextAttempt) {
+		circuit = "open"
+	}
+
+	status := map[string]interface{}{
+		"consecutive_failures": r.failures,
+		"circuit":              circuit,
+		"in_progress":          r.inflight != nil,
+	}
+	if r.lastError != "" {
+		status["last_error"] = r.lastError
+	}
+	if !r.nextAttempt.IsZero() {
+		status["next_attempt"] = r.nextAttempt.Unix()
+	}
+	return status
+}
+
+// hasCloudCredentials reports whether the Enlighten login flow can be used
+func (g *Gateway) hasCloudCredentials() bool {
+	return g.config.User != "" && g.config.Password != ""
+}
+
+// hasLocalToken reports whether a locally provisioned token is configured
+func (g *Gateway) hasLocalToken() bool {
+	return g.config.Token != "" || g.config.TokenFile != "" || g.config.TokenEnv != ""
+}
+
+// initToken obtains the initial token. A locally provisioned token is
+// preferred so the exporter can start without internet access; the cloud
+// login flow is only used when it is configured.
+func (g *Gateway) initToken() error {
+	if g.hasLocalToken() {
+		err := g.loadLocalToken()
+		if err == nil {
+			return nil
+		}
+		if !g.hasCloudCredentials() {
+			return err
+		}
+		LogWarning("Local token unavailable (%v), falling back to Enlighten login", err)
+	}
+
+	// Reuse the token persisted by a previous run
+	err := g.restoreTokenState()
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		LogInfo("Not reusing persisted token: %v", err)
+	}
+
+	if !g.hasCloudCredentials() {
+		return fmt.Errorf("no token configured and no Enlighten credentials to request one")
+	}
+
+	return g.refreshToken()
+}
+
+// renewToken obtains a fresh token from the configured source, falling back
+// to the Enlighten login flow when cloud credentials are available. Ending up
+// with the token already in use is not a renewal.
+func (g *Gateway) renewToken() error {
+	previous := g.getToken()
+	err := g.obtainToken()
+	if err == nil && g.getToken() == previous {
+		return fmt.Errorf("no replacement token available")
+	}
+	return err
+}
+
+func (g *Gateway) obtainToken() error {
+	if g.hasLocalToken() {
+		err := g.loadLocalToken()
+		if err == nil && !g.tokenNeedsRefresh() {
+			return nil
+		}
+		if !g.hasCloudCredentials() {
+			return err
+		}
+		if err != nil {
+			LogWarning("Local token unavailable (%v), falling back to Enlighten login", err)
+		} else {
+			LogWarning("Local token expires soon, requesting a new one from Enlighten")
+		}
+	}
+
+	if !g.hasCloudCredentials() {
+		return fmt.Errorf("no local token or Enlighten credentials configured")
+	}
+	return g.refreshToken()
+}
+
+// loadLocalToken loads the token from token_file, token_env or the inline
+// token, in that order of precedence.
+func (g *Gateway) loadLocalToken() error {
+	if g.config.TokenFile != "" {
+		token, modTime, err := readTokenFile(g.config.TokenFile)
+		if err == nil {
+			err = g.applyToken(token, 0, tokenSourceFile)
+		}
+		if err == nil {
+			g.tokenMutex.Lock()
+			g.tokenFileModTime = modTime
+			g.tokenMutex.Unlock()
+
+			LogInfo("Loaded token from file %s", g.config.TokenFile)
+			return nil
+		}
+		if g.config.TokenEnv == "" && g.config.Token == "" {
+			return err
+		}
+		LogWarning("Failed to load token file: %v", err)
+	}
+
+	if g.config.TokenEnv != "" {
+		err := fmt.Errorf("environment variable %s is not set", g.config.TokenEnv)
+		if token := strings.TrimSpace(os.Getenv(g.config.TokenEnv)); token != "" {
+			err = g.applyToken(token, 0, tokenSourceEnv)
+			if err == nil {
+				LogInfo("Loaded token from environment variable %s", g.config.TokenEnv)
+				return nil
+			}
+		}
+		if g.config.Token == "" {
+			return err
+		}
+		LogWarning("Failed to load token from environment: %v", err)
+	}
+
+	if token := strings.TrimSpace(g.config.Token); token != "" {
+		if err := g.applyToken(token, 0, tokenSourceConfig); err != nil {
+			return err
+		}
+		LogInfo("Using token from configuration file")
+		return nil
+	}
+
+	return fmt.Errorf("no local token configured")
+}
+
+// readTokenFile reads a token file, returning its trimmed contents and
+// modification time
+func readTokenFile(path string) (string, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to stat token file: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", time.Time{}, fmt.Errorf("token file %s is empty", path)
+	}
+
+	return token, info.ModTime(), nil
+}
+
+// watchTokenFile reloads the token whenever token_file is rotated
+func (g *Gateway) watchTokenFile() {
+	ticker := time.NewTicker(tokenFileCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-g.stopped:
+			return
+		}
+
+		info, err := os.Stat(g.config.TokenFile)
+		if err != nil {
+			LogDebug("Token file check failed: %v", err)
+			continue
+		}
+
+		g.tokenMutex.RLock()
+		lastModTime := g.tokenFileModTime
+		g.tokenMutex.RUnlock()
+
+		if info.ModTime().Equal(lastModTime) {
+			continue
+		}
+
+		token, modTime, err := readTokenFile(g.config.TokenFile)
+		if err == nil {
+			err = g.applyToken(token, 0, tokenSourceFile)
+		}
+
+		// Remember the modification time either way so a bad token is only
+		// reported once per rotation
+		g.tokenMutex.Lock()
+		g.tokenFileModTime = modTime
+		g.tokenMutex.Unlock()
+
+		if err != nil {
+			LogWarning("Token file changed but could not be loaded: %v", err)
+			continue
+		}
+
+		LogInfo("Token file %s rotated, token reloaded", g.config.TokenFile)
+	}
+}
+
+// applyToken decodes the token's JWT claims and makes it the active token.
+// The expiry comes from the exp claim; defaultExpires is only used when the
+// token cannot be decoded. Tokens issued for a different gateway, or that
+// have already expired, are rejected.
+func (g *Gateway) applyToken(token string, defaultExpires int64, source string) error {
+	if g.isRejectedToken(token) {
+		return fmt.Errorf("token was previously rejected by the gateway")
+	}
+
+	expires := defaultExpires
+	scope := tokenScopeUnknown
+	var issued int64
+
+	claims, err := parseEnvoyToken(token)
+	if err != nil {
+		LogWarning("Unable to decode token claims (%v), assuming default expiry", err)
+	} else {
+		serial := claims.GatewaySerial()
+		if serial != "" && g.config.EnvoySerial != "" && serial != g.config.EnvoySerial {
+			return fmt.Errorf("token was issued for gateway %s, expected %s", serial, g.config.EnvoySerial)
+		}
+		if claims.ExpiresAt > 0 {
+			expires = claims.ExpiresAt
+		}
+		scope = claims.Scope()
+		issued = claims.IssuedAt
+	}
+
+	if expires > 0 && expires <= time.Now().Unix() {
+		return fmt.Errorf("token expired at %s", time.Unix(expires, 0))
+	}
+
+	g.setToken(token, expires, source, scope, issued)
+	return nil
+}
+
+// setToken stores the active token along with its expiry, source and scope
+func (g *Gateway) setToken(token string, expires int64, source, scope string, issued int64) {
+	g.tokenMutex.Lock()
+	g.token = token
+	g.tokenExpires = expires
+	g.tokenSource = source
+	g.tokenScope = scope
+	g.tokenIssued = issued
+	g.tokenMutex.Unlock()
+}
+
+// tokenNeedsRefresh reports whether the active token is within the refresh
+// window of its expiry
+func (g *Gateway) tokenNeedsRefresh() bool {
+	g.tokenMutex.RLock()
+	defer g.tokenMutex.RUnlock()
+	return g.tokenExpires > 0 && time.Until(time.Unix(g.tokenExpires, 0)) < tokenRefreshWindow
+}
+
+func (g *Gateway) refreshToken() error {
+	// Login to get session ID
+	loginData := url.Values{}
+	loginData.Set("user[email]", g.config.User)
+	loginData.Set("user[password]", g.config.Password)
+
+	resp, err := g.cloudClient.PostForm(g.config.Cloud.EnlightenURL+"/login/login.json?", loginData)
+	if err != nil {
+		return fmt.Errorf("login request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var loginResp LoginResponse
+	err = json.NewDecoder(resp.Body).Decode(&loginResp)
+	if err != nil {
+		return fmt.Errorf("failed to decode login response: %w", err)
+	}
+
+	if loginResp.Message != "success" {
+		return fmt.Errorf("login failed: %s", loginResp.Message)
+	}
+
+	// Get web token
+	tokenReq := map[string]interface{}{
+		"session_id": loginResp.SessionID,
+		"serial_num": g.config.EnvoySerial,
+		"username":   g.config.User,
+	}
+
+	tokenData, err := json.Marshal(tokenReq)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token request: %w", err)
+	}
+
+	req, err := http.NewRequest("POST", g.config.Cloud.EntrezURL+"/tokens", strings.NewReader(string(tokenData)))
+	if err != nil {
+		return fmt.Errorf("failed to create token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err = g.cloudClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	tokenBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read token response: %w", err)
+	}
+
+	// Parse as TokenResponse if it's JSON, otherwise use as raw token
+	var tokenResp TokenResponse
+	if err := json.Unmarshal(tokenBody, &tokenResp); err == nil && tokenResp.Token != "" {
+		err = g.applyToken(tokenResp.Token, tokenResp.ExpiresAt, tokenSourceCloud)
+		if err != nil {
+			return err
+		}
+	} else {
+		// Raw token string; the JWT claims carry the real expiry
+		err = g.applyToken(strings.TrimSpace(string(tokenBody)), time.Now().Add(24*time.Hour).Unix(), tokenSourceCloud)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Persist the new token so a restart does not need another login.
+	// Locally provisioned tokens already live on disk or in the environment.
+	g.saveTokenState()
+
+	g.tokenMutex.RLock()
+	expires := g.tokenExpires
+	scope := g.tokenScope
+	g.tokenMutex.RUnlock()
+
+	LogInfo("Token refreshed (%s scope), expires at: %s", scope, time.Unix(expires, 0))
+	return nil
+}
+
+func (g *Gateway) tokenRefreshLoop() {
+	for {
+		g.tokenMutex.RLock()
+		expiresAt := g.tokenExpires
+		g.tokenMutex.RUnlock()
+
+		// Locally provisioned tokens without a known expiry are never renewed
+		// here; token_file rotation is handled by watchTokenFile
+		if expiresAt == 0 {
+			if !g.sleep(5 * time.Minute) {
+				return
+			}
+			continue
+		}
+
+		// Refresh 1 hour before expiry
+		refreshTime := time.Unix(expiresAt, 0).Add(-tokenRefreshWindow)
+		sleepDuration := time.Until(refreshTime)
+
+		if sleepDuration <= 0 {
+			sleepDuration = 5 * time.Minute // Retry in 5 minutes if already expired
+		}
+
+		if !g.sleep(sleepDuration) {
+			return
+		}
+
+		err := g.coalescedRefresh(context.Background(), g.getToken(), false)
+		if err != nil {
+			LogInfo("Failed to refresh token: %v", err)
+			if !g.sleep(5 * time.Minute) { // Retry in 5 minutes
+				return
+			}
+		}
+	}
+}
+
+func (g *Gateway) getToken() string {
+	g.tokenMutex.RLock()
+	defer g.tokenMutex.RUnlock()
+	return g.token
+}
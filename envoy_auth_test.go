@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenRejectionExpires(t *testing.T) {
+	tests := []struct {
+		name     string
+		token    string
+		rejected string
+		age      time.Duration
+		want     bool
+	}{
+		{"just rejected", "tok", "tok", time.Minute, true},
+		{"rejection expired", "tok", "tok", tokenRejectionPeriod + time.Second, false},
+		{"other token", "new", "tok", time.Minute, false},
+		{"no token", "", "", time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &Gateway{}
+			g.refresh.rejectedToken = tt.rejected
+			g.refresh.rejectedAt = time.Now().Add(-tt.age)
+			if got := g.isRejectedToken(tt.token); got != tt.want {
+				t.Errorf("isRejectedToken(%q) = %v, want %v", tt.token, got, tt.want)
+			}
+		})
+	}
+}
+
+// A gateway that only accepts the token while accept is set, as during and
+// after a reboot
+func testRebootingGateway(t *testing.T, accept *atomic.Bool) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !accept.Load() || r.Header.Get("Authorization") != "Bearer tok" && r.Header.Get("Cookie") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/auth/check_jwt" {
+			http.SetCookie(w, &http.Cookie{Name: "sessionId", Value: "s"})
+			w.Write([]byte("<!DOCTYPE html><h2>Valid token.</h2>"))
+			return
+		}
+		w.Write([]byte(`{"wattsNow": 1}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLocalTokenRecoversAfterRejection(t *testing.T) {
+	var accept atomic.Bool
+	server := testRebootingGateway(t, &accept)
+
+	g, err := newGateway("test", "test", Config{
+		EnvoyIP:  strings.TrimPrefix(server.URL, "https://"),
+		Token:    "tok",
+		AuthMode: authModeJWT,
+		WebDir:   t.TempDir(),
+		StateDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("newGateway: %v", err)
+	}
+	if err := g.initToken(); err != nil {
+		t.Fatalf("initToken: %v", err)
+	}
+
+	request := func() error {
+		_, _, err := g.makeEnvoyRequest(context.Background(), "https://{envoy_ip}/api/v1/production", responseFormat{kind: formatJSON})
+		return err
+	}
+
+	// The gateway refuses the only token there is: no renewal is possible
+	if err := request(); !isUnauthorized(err) {
+		t.Fatalf("request while rejected: error = %v, want unauthorized", err)
+	}
+	if failures := g.refreshStatus()["consecutive_failures"]; failures != 1 {
+		t.Errorf("consecutive_failures = %v, want 1: reloading the same token is not a renewal", failures)
+	}
+	if !g.isRejectedToken("tok") {
+		t.Errorf("token not marked as rejected")
+	}
+	if err := g.applyToken("tok", 0, tokenSourceFile); err == nil {
+		t.Errorf("rejected token reloaded within the rejection period")
+	}
+
+	// Once the gateway accepts it again the rejection and backoff are cleared
+	accept.Store(true)
+	if err := request(); err != nil {
+		t.Fatalf("request after recovery: %v", err)
+	}
+	if g.isRejectedToken("tok") {
+		t.Errorf("token still rejected after the gateway accepted it")
+	}
+	if failures := g.refreshStatus()["consecutive_failures"]; failures != 0 {
+		t.Errorf("consecutive_failures = %v, want 0", failures)
+	}
+	if err := g.applyToken("tok", 0, tokenSourceFile); err != nil {
+		t.Errorf("applyToken after recovery: %v", err)
+	}
+}
+
+func TestRenewTokenRequiresNewToken(t *testing.T) {
+	g := &Gateway{config: Config{Token: "tok"}}
+	if err := g.applyToken("tok", 0, tokenSourceConfig); err != nil {
+		t.Fatalf("applyToken: %v", err)
+	}
+	if err := g.renewToken(); err == nil {
+		t.Errorf("renewToken succeeded without changing the token")
+	}
+
+	g.config.Token = "tok2"
+	if err := g.renewToken(); err != nil {
+		t.Errorf("renewToken with a new local token: %v", err)
+	}
+	if token := g.getToken(); token != "tok2" {
+		t.Errorf("token = %q, want tok2", token)
+	}
+}
+
+func TestRenewTokenWithoutCredentials(t *testing.T) {
+	var logins atomic.Int32
+	cloud := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logins.Add(1)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer cloud.Close()
+
+	g, err := newGateway("test", "test", Config{
+		EnvoyIP:  "192.0.2.1",
+		AuthMode: authModeJWT,
+		Cloud:    CloudConfig{EnlightenURL: cloud.URL, EntrezURL: cloud.URL},
+		WebDir:   t.TempDir(),
+		StateDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("newGateway: %v", err)
+	}
+
+	err = g.renewToken()
+	if err == nil || !strings.Contains(err.Error(), "no local token or Enlighten credentials") {
+		t.Errorf("renewToken error = %v, want one about missing credentials", err)
+	}
+	if n := logins.Load(); n != 0 {
+		t.Errorf("%d Enlighten logins attempted without credentials", n)
+	}
+}
+
+func TestReauthenticateHonoursContext(t *testing.T) {
+	release := make(chan struct{})
+	cloud := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer cloud.Close()
+	defer close(release)
+
+	var accept atomic.Bool
+	gateway := testRebootingGateway(t, &accept)
+
+	g, err := newGateway("test", "test", Config{
+		EnvoyIP:  strings.TrimPrefix(gateway.URL, "https://"),
+		AuthMode: authModeJWT,
+		User:     "owner@example.com",
+		Password: "secret",
+		Cloud:    CloudConfig{EnlightenURL: cloud.URL, EntrezURL: cloud.URL},
+		WebDir:   t.TempDir(),
+		StateDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("newGateway: %v", err)
+	}
+
+	// The request gives up with its context while the login is still
+	// running, which carries on for the next caller
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err = g.makeEnvoyRequest(ctx, "https://{envoy_ip}/api/v1/production", responseFormat{kind: formatJSON})
+	if err == nil || !strings.Contains(err.Error(), "waiting for token refresh") {
+		t.Errorf("error = %v, want one about waiting for the refresh", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("request took %v after its context expired", elapsed)
+	}
+	if inProgress := g.refreshStatus()["in_progress"]; inProgress != true {
+		t.Errorf("in_progress = %v, want the refresh still running", inProgress)
+	}
+}
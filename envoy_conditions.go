@@ -0,0 +1,222 @@
+// envoy_conditions.go - Named conditions gating queries, metrics and calculations
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A <condition> check is an expression in the calculation language (see
+// envoy_expression.go), evaluated against the response or item a query or
+// metric is reading and the metrics collected so far. Besides metric names
+// a check may use:
+//
+//	endpoint_accessible       the response was received and decoded
+//	json_path_exists("path")  the path selects a node
+//	json_path_value("path")   the first node the path selects
+//	array_has_type("type")    an element of the item has that type member
+//	metric_value("name")      a metric's series, like its bare name
+//
+// A condition holds when it evaluates to a nonzero number, or to a vector
+// with a nonzero series. A check reading a path or metric that is missing
+// does not hold; within and/or such an operand counts as false, so
+// json_path_value("a") > 0 or json_path_value("b") > 0 holds on either.
+// Calculated metrics have no item, so only metrics apply to them.
+
+// conditionDocument is the name under which the environment holds the item
+// being read. It cannot be written as an identifier.
+const conditionDocument = "$"
+
+// checkCondition reports whether a named condition holds for an item
+func (g *Gateway) checkCondition(name string, data interface{}) bool {
+	if name == "" {
+		return true
+	}
+	g.cacheMutex.RLock()
+	defer g.cacheMutex.RUnlock()
+	return g.conditionHolds(name, data)
+}
+
+// conditionHolds is checkCondition for callers holding cacheMutex
+func (g *Gateway) conditionHolds(name string, data interface{}) bool {
+	if name == "" {
+		return true
+	}
+
+	condition, ok := findCondition(g.config.Conditions, name)
+	if !ok {
+		// validateConditions rejects this for configured gateways, but a
+		// probe's auth module may bring its own queries
+		LogWarning("Gateway %s: unknown condition %q", g.name, name)
+		return false
+	}
+
+	env := func(identifier string) (interface{}, bool) {
+		switch identifier {
+		case conditionDocument:
+			return data, data != nil
+		case "endpoint_accessible":
+			return data != nil, true
+		}
+		value, ok := g.metricCache[identifier]
+		return value, ok
+	}
+
+	value, err := evaluateSeries(condition.Check, env)
+	if err != nil {
+		LogDebug("Gateway %s: condition %s does not hold: %v", g.name, name, err)
+		return false
+	}
+	return holds(value)
+}
+
+func findCondition(conditions Conditions, name string) (Condition, bool) {
+	for _, condition := range conditions.Conditions {
+		if condition.Name == name {
+			return condition, true
+		}
+	}
+	return Condition{}, false
+}
+
+// holds reports whether a number is nonzero, or a vector has a nonzero series
+func holds(value interface{}) bool {
+	switch v := value.(type) {
+	case float64:
+		return v != 0
+	case exprVector:
+		for _, series := range v {
+			if series.Value != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateConditions parses every check and rejects conditions that are
+// referenced but not defined, which would otherwise never hold
+func validateConditions(conditions Conditions, queries []Query, calculations []CalculatedMetric) error {
+	defined := make(map[string]bool)
+	for i, condition := range conditions.Conditions {
+		if condition.Name == "" {
+			return fmt.Errorf("condition %d has no name", i+1)
+		}
+		if defined[condition.Name] {
+			return fmt.Errorf("duplicate condition name %q", condition.Name)
+		}
+		defined[condition.Name] = true
+
+		if strings.TrimSpace(condition.Check) == "" {
+			return fmt.Errorf("condition %s has no check", condition.Name)
+		}
+		if _, err := compileExpression(condition.Check); err != nil {
+			return fmt.Errorf("condition %s: %w", condition.Name, err)
+		}
+	}
+
+	known := func(kind, owner, name string) error {
+		if name != "" && !defined[name] {
+			return fmt.Errorf("%s %s: unknown condition %q", kind, owner, name)
+		}
+		return nil
+	}
+	for _, query := range queries {
+		if err := known("query", query.Name, query.Condition); err != nil {
+			return err
+		}
+		for _, metric := range query.Metrics {
+			if err := known("metric", metric.Name, metric.Condition); err != nil {
+				return err
+			}
+		}
+	}
+	for _, calc := range calculations {
+		if err := known("calculated metric", calc.Name, calc.Condition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Functions reading the item, registered in exprFunctions
+
+// stringArgument evaluates an argument that must be a quoted string
+func stringArgument(function string, arg exprNode, env exprEnv) (string, error) {
+	value, err := arg.eval(env)
+	if err != nil {
+		return "", err
+	}
+	text, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("%s() takes a quoted string", function)
+	}
+	return text, nil
+}
+
+// documentMatches evaluates a path argument against the item. Without an
+// item the path is undefined.
+func documentMatches(function string, args []exprNode, env exprEnv) (string, []jsonPathMatch, error) {
+	path, err := stringArgument(function, args[0], env)
+	if err != nil {
+		return "", nil, err
+	}
+	data, ok := env(conditionDocument)
+	if !ok {
+		return path, nil, &undefinedError{Name: path}
+	}
+	matches, err := evaluateJSONPath(data, path)
+	return path, matches, err
+}
+
+func jsonPathExistsFunction(args []exprNode, env exprEnv) (interface{}, error) {
+	_, matches, err := documentMatches("json_path_exists", args, env)
+	if _, undefined := err.(*undefinedError); undefined {
+		return 0.0, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return truth(len(matches) > 0 && matches[0].Value != nil), nil
+}
+
+func jsonPathValueFunction(args []exprNode, env exprEnv) (interface{}, error) {
+	path, matches, err := documentMatches("json_path_value", args, env)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 || matches[0].Value == nil {
+		return nil, &undefinedError{Name: path}
+	}
+	switch v := matches[0].Value.(type) {
+	case float64, string:
+		return v, nil
+	case bool:
+		return truth(v), nil
+	default:
+		return nil, fmt.Errorf("json_path_value(%q) selects an object or array", path)
+	}
+}
+
+func arrayHasTypeFunction(args []exprNode, env exprEnv) (interface{}, error) {
+	kind, err := stringArgument("array_has_type", args[0], env)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := env(conditionDocument)
+	items, _ := data.([]interface{})
+	for _, item := range items {
+		if fields, ok := item.(map[string]interface{}); ok && fields["type"] == kind {
+			return 1.0, nil
+		}
+	}
+	return 0.0, nil
+}
+
+func metricValueFunction(args []exprNode, env exprEnv) (interface{}, error) {
+	name, err := stringArgument("metric_value", args[0], env)
+	if err != nil {
+		return nil, err
+	}
+	return (&identNode{name: name}).eval(env)
+}
@@ -0,0 +1,256 @@
+// envoy_digest.go - HTTP digest authentication for legacy (pre-JWT) firmware
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Authentication modes
+const (
+	authModeJWT    = "jwt"    // Enlighten-issued JWT (firmware 7.x and later)
+	authModeDigest = "digest" // HTTP digest auth (firmware D5/D7)
+	authModeNone   = "none"   // no authentication
+)
+
+// Digest users understood by legacy firmware
+const (
+	digestUserEnvoy     = "envoy"
+	digestUserInstaller = "installer"
+)
+
+const digestRealm = "enphaseenergy.com"
+
+// digestTransport answers HTTP digest challenges transparently, so callers
+// see the same responses as with any other auth mode. The last challenge is
+// reused so most requests need a single round trip.
+type digestTransport struct {
+	base     http.RoundTripper
+	user     string
+	password string
+
+	mutex      sync.Mutex
+	challenge  map[string]string
+	nonceCount int
+}
+
+func newDigestTransport(base http.RoundTripper, user, password string) *digestTransport {
+	return &digestTransport{
+		base:     base,
+		user:     user,
+		password: password,
+	}
+}
+
+func (t *digestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if auth := t.authorization(req); auth != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", auth)
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+
+	challenge := parseDigestChallenge(resp.Header.Get("WWW-Authenticate"))
+	if challenge == nil {
+		return resp, nil
+	}
+
+	// Stale or missing nonce: answer the new challenge once
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	t.mutex.Lock()
+	t.challenge = challenge
+	t.nonceCount = 0
+	t.mutex.Unlock()
+
+	retry := req.Clone(req.Context())
+	retry.Header.Set("Authorization", t.authorization(req))
+	return t.base.RoundTrip(retry)
+}
+
+// authorization builds the Authorization header for the current challenge
+func (t *digestTransport) authorization(req *http.Request) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.challenge == nil {
+		return ""
+	}
+
+	realm := t.challenge["realm"]
+	nonce := t.challenge["nonce"]
+	uri := req.URL.RequestURI()
+
+	ha1 := md5Hex(t.user + ":" + realm + ":" + t.password)
+	ha2 := md5Hex(req.Method + ":" + uri)
+
+	header := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`, t.user, realm, nonce, uri)
+
+	if qopSupportsAuth(t.challenge["qop"]) {
+		t.nonceCount++
+		nc := fmt.Sprintf("%08x", t.nonceCount)
+		cnonce := randomHex(8)
+		response := md5Hex(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":auth:" + ha2)
+		header += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s", response="%s"`, nc, cnonce, response)
+	} else {
+		header += fmt.Sprintf(`, response="%s"`, md5Hex(ha1+":"+nonce+":"+ha2))
+	}
+
+	if opaque, ok := t.challenge["opaque"]; ok {
+		header += fmt.Sprintf(`, opaque="%s"`, opaque)
+	}
+	if algorithm, ok := t.challenge["algorithm"]; ok {
+		header += ", algorithm=" + algorithm
+	}
+
+	return header
+}
+
+// parseDigestChallenge parses a WWW-Authenticate: Digest header into its
+// parameters, returning nil for other schemes
+func parseDigestChallenge(header string) map[string]string {
+	header = strings.TrimSpace(header)
+	if len(header) < 7 || !strings.EqualFold(header[:7], "digest ") {
+		return nil
+	}
+
+	params := make(map[string]string)
+	rest := header[7:]
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.IndexByte(rest, ','); comma >= 0 {
+			value, rest = strings.TrimSpace(rest[:comma]), rest[comma+1:]
+		} else {
+			value, rest = strings.TrimSpace(rest), ""
+		}
+		params[key] = value
+	}
+
+	if params["nonce"] == "" {
+		return nil
+	}
+	return params
+}
+
+func qopSupportsAuth(qop string) bool {
+	for _, option := range strings.Split(qop, ",") {
+		if strings.TrimSpace(option) == "auth" {
+			return true
+		}
+	}
+	return false
+}
+
+// digestCredentials returns the digest user and password. Without an
+// explicit password it is derived from the serial the way the gateway does:
+// the last six digits for "envoy", the Enphase mobile algorithm for
+// "installer".
+func digestCredentials(config Config) (string, string, error) {
+	user := config.DigestUser
+	if user == "" {
+		user = digestUserEnvoy
+	}
+
+	if config.DigestPassword != "" {
+		return user, config.DigestPassword, nil
+	}
+
+	serial := config.EnvoySerial
+	if serial == "" {
+		return "", "", fmt.Errorf("digest auth needs envoy_serial or digest_password")
+	}
+
+	switch user {
+	case digestUserEnvoy:
+		if len(serial) < 6 {
+			return "", "", fmt.Errorf("envoy_serial %q is too short to derive a password", serial)
+		}
+		return user, serial[len(serial)-6:], nil
+	case digestUserInstaller:
+		return user, deriveInstallerPassword(serial, user), nil
+	default:
+		return "", "", fmt.Errorf("cannot derive a password for digest user %q, set digest_password", user)
+	}
+}
+
+// deriveInstallerPassword implements the serial-based password generator
+// used by the Enphase installer toolkit (emupwGetMobilePasswd)
+func deriveInstallerPassword(serial, user string) string {
+	sum := md5.Sum([]byte("[e]" + user + "@" + digestRealm + "#" + serial + " EnPhAsE eNeRgY "))
+	digest := hex.EncodeToString(sum[:])
+
+	countZero := strings.Count(digest, "0")
+	countOne := strings.Count(digest, "1")
+
+	var password strings.Builder
+	for i := len(digest) - 1; i >= len(digest)-8; i-- {
+		if countZero == 3 || countZero == 6 || countZero == 9 {
+			countZero--
+		}
+		if countZero > 20 {
+			countZero = 20
+		}
+		if countZero < 0 {
+			countZero = 0
+		}
+
+		if countOne == 9 || countOne == 15 {
+			countOne--
+		}
+		if countOne > 26 {
+			countOne = 26
+		}
+		if countOne < 0 {
+			countOne = 0
+		}
+
+		switch c := digest[i]; c {
+		case '0':
+			password.WriteByte(byte('f' + countZero))
+			countZero--
+		case '1':
+			password.WriteByte(byte('@' + countOne))
+			countOne--
+		default:
+			password.WriteByte(c)
+		}
+	}
+
+	return password.String()
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
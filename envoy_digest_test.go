@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseDigestChallenge(t *testing.T) {
+	tests := []struct {
+		header string
+		want   map[string]string
+	}{
+		{
+			`Digest realm="enphaseenergy.com", qop="auth", nonce="abc123"`,
+			map[string]string{"realm": "enphaseenergy.com", "qop": "auth", "nonce": "abc123"},
+		},
+		{
+			`digest Realm="a, b",nonce="n", opaque="o", algorithm=MD5, stale=FALSE`,
+			map[string]string{"realm": "a, b", "nonce": "n", "opaque": "o", "algorithm": "MD5", "stale": "FALSE"},
+		},
+		{
+			`  Digest qop="auth,auth-int", nonce="n"  `,
+			map[string]string{"qop": "auth,auth-int", "nonce": "n"},
+		},
+		{`Digest nonce="unterminated`, map[string]string{"nonce": "unterminated"}},
+		{`Digest realm="enphaseenergy.com"`, nil},
+		{`Basic realm="enphaseenergy.com"`, nil},
+		{`Digest`, nil},
+		{``, nil},
+	}
+	for _, tt := range tests {
+		if got := parseDigestChallenge(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDigestChallenge(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestDeriveInstallerPassword(t *testing.T) {
+	tests := []struct {
+		serial string
+		want   string
+	}{
+		{"122012345678", "266C5dBf"},
+		{"121437001234", "j3cfa3b2"},
+		{"202312000001", "53EcDC6b"},
+		{"123456789012", "7edE24ed"},
+	}
+	for _, tt := range tests {
+		if got := deriveInstallerPassword(tt.serial, digestUserInstaller); got != tt.want {
+			t.Errorf("deriveInstallerPassword(%q) = %q, want %q", tt.serial, got, tt.want)
+		}
+	}
+}
+
+func TestDigestCredentials(t *testing.T) {
+	tests := []struct {
+		name           string
+		config         Config
+		user, password string
+		errors         bool
+	}{
+		{"envoy from serial", Config{EnvoySerial: "122012345678"}, "envoy", "345678", false},
+		{"installer from serial", Config{EnvoySerial: "122012345678", DigestUser: "installer"}, "installer", "266C5dBf", false},
+		{"explicit password", Config{DigestUser: "admin", DigestPassword: "pw"}, "admin", "pw", false},
+		{"no serial", Config{}, "", "", true},
+		{"short serial", Config{EnvoySerial: "1234"}, "", "", true},
+		{"unknown user", Config{EnvoySerial: "122012345678", DigestUser: "admin"}, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, password, err := digestCredentials(tt.config)
+			if (err != nil) != tt.errors {
+				t.Fatalf("error = %v, want error %v", err, tt.errors)
+			}
+			if user != tt.user || password != tt.password {
+				t.Errorf("credentials = %q/%q, want %q/%q", user, password, tt.user, tt.password)
+			}
+		})
+	}
+}
+
+func TestDigestTransport(t *testing.T) {
+	const nonce = "n0nce"
+	var challenges int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := parseDigestChallenge(r.Header.Get("Authorization"))
+		if params == nil {
+			challenges++
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Digest realm="%s", qop="auth", nonce="%s", opaque="op"`, digestRealm, nonce))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ha1 := md5Hex("envoy:" + digestRealm + ":345678")
+		ha2 := md5Hex(r.Method + ":" + params["uri"])
+		want := md5Hex(ha1 + ":" + nonce + ":" + params["nc"] + ":" + params["cnonce"] + ":auth:" + ha2)
+		if params["username"] != "envoy" || params["response"] != want || params["opaque"] != "op" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: newDigestTransport(http.DefaultTransport, "envoy", "345678")}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(server.URL + "/api/v1/production?x=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, resp.StatusCode)
+		}
+	}
+	if challenges != 1 {
+		t.Errorf("challenges = %d, want 1: the challenge should be reused", challenges)
+	}
+}
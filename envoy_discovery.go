@@ -0,0 +1,314 @@
+// envoy_discovery.go - Gateway discovery on the LAN via mDNS
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	envoyServiceName         = "_enphase-envoy._tcp.local."
+	mdnsGroupAddress         = "224.0.0.251:5353"
+	defaultDiscoveryInterval = 60              // seconds
+	discoveryListenTime      = 3 * time.Second // how long to collect answers
+
+	addressSourceStatic = "static"
+	addressSourceMDNS   = "mdns"
+)
+
+// discoveredGateway is one gateway that answered the mDNS browse
+type discoveredGateway struct {
+	Instance string
+	Serial   string
+	Address  string
+}
+
+// mdnsInstance collects the records describing one service instance, which
+// may arrive spread over several answers
+type mdnsInstance struct {
+	serial string
+	host   string
+	source string // address the answer came from
+}
+
+// browseEnvoys sends a PTR query for the Envoy service and collects answers.
+// The query goes out from an ephemeral port, so responders answer unicast
+// (RFC 6762 section 6.7) and no port 5353 listener is needed.
+func browseEnvoys(ifaceName string) ([]discoveredGateway, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mDNS socket: %w", err)
+	}
+	defer conn.Close()
+
+	if ifaceName != "" {
+		iface, err := net.InterfaceByName(ifaceName)
+		if err != nil {
+			return nil, fmt.Errorf("discovery interface %s: %w", ifaceName, err)
+		}
+		if err := ipv4.NewPacketConn(conn).SetMulticastInterface(iface); err != nil {
+			return nil, fmt.Errorf("discovery interface %s: %w", ifaceName, err)
+		}
+	}
+
+	group, err := net.ResolveUDPAddr("udp4", mdnsGroupAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	query, err := buildServiceQuery()
+	if err != nil {
+		return nil, err
+	}
+
+	// Multicast is lossy; ask twice within the listening window
+	if _, err := conn.WriteToUDP(query, group); err != nil {
+		return nil, fmt.Errorf("failed to send mDNS query: %w", err)
+	}
+	resend := time.Now().Add(discoveryListenTime / 3)
+	resent := false
+
+	instances := make(map[string]*mdnsInstance)
+	hosts := make(map[string]string)
+
+	deadline := time.Now().Add(discoveryListenTime)
+	buf := make([]byte, 9000)
+	for time.Now().Before(deadline) {
+		readUntil := deadline
+		if !resent {
+			readUntil = resend
+		}
+		conn.SetReadDeadline(readUntil)
+
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if !resent {
+					conn.WriteToUDP(query, group)
+					resent = true
+				}
+				continue
+			}
+			return nil, fmt.Errorf("failed to read mDNS answer: %w", err)
+		}
+
+		parseServiceAnswer(buf[:n], from.IP.String(), instances, hosts)
+	}
+
+	found := make([]discoveredGateway, 0, len(instances))
+	for name, instance := range instances {
+		address := hosts[instance.host]
+		if address == "" {
+			address = instance.source
+		}
+		found = append(found, discoveredGateway{
+			Instance: strings.TrimSuffix(name, "."+envoyServiceName),
+			Serial:   instance.serial,
+			Address:  address,
+		})
+	}
+
+	return found, nil
+}
+
+func buildServiceQuery() ([]byte, error) {
+	name, err := dnsmessage.NewName(envoyServiceName)
+	if err != nil {
+		return nil, err
+	}
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: uint16(rand.Intn(0xffff) + 1)})
+	if err := builder.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := builder.Question(dnsmessage.Question{
+		Name:  name,
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}); err != nil {
+		return nil, err
+	}
+	return builder.Finish()
+}
+
+// parseServiceAnswer records the PTR, SRV, TXT and A records of one answer.
+// Malformed packets are ignored.
+func parseServiceAnswer(packet []byte, source string, instances map[string]*mdnsInstance, hosts map[string]string) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(packet)
+	if err != nil || !header.Response {
+		return
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return
+	}
+
+	answers, err := parser.AllAnswers()
+	if err != nil {
+		return
+	}
+	if err := parser.SkipAllAuthorities(); err != nil {
+		return
+	}
+	additionals, _ := parser.AllAdditionals()
+
+	instance := func(name string) *mdnsInstance {
+		if instances[name] == nil {
+			instances[name] = &mdnsInstance{source: source}
+		}
+		return instances[name]
+	}
+
+	for _, record := range append(answers, additionals...) {
+		name := strings.ToLower(record.Header.Name.String())
+
+		switch body := record.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name == envoyServiceName {
+				instance(strings.ToLower(body.PTR.String()))
+			}
+		case *dnsmessage.SRVResource:
+			if strings.HasSuffix(name, "."+envoyServiceName) {
+				instance(name).host = strings.ToLower(body.Target.String())
+			}
+		case *dnsmessage.TXTResource:
+			if strings.HasSuffix(name, "."+envoyServiceName) {
+				for _, entry := range body.TXT {
+					if key, value, ok := strings.Cut(entry, "="); ok && strings.EqualFold(key, "serialnum") {
+						instance(name).serial = value
+					}
+				}
+			}
+		case *dnsmessage.AResource:
+			hosts[name] = net.IP(body.A[:]).String()
+		}
+	}
+}
+
+// discoveryEnabled reports whether any gateway relies on mDNS for its address
+func (e *EnvoyExporter) discoveryEnabled() bool {
+	for _, g := range e.gateways {
+		if g.discover {
+			return true
+		}
+	}
+	return false
+}
+
+// runDiscovery browses once and moves gateways to their advertised address
+func (e *EnvoyExporter) runDiscovery() {
+	found, err := browseEnvoys(e.config.Discovery.Interface)
+	if err != nil {
+		LogWarning("Gateway discovery failed: %v", err)
+		return
+	}
+	LogDebug("Gateway discovery found %d gateway(s)", len(found))
+
+	discovering := 0
+	for _, g := range e.gateways {
+		if g.discover {
+			discovering++
+		}
+	}
+
+	for _, g := range e.gateways {
+		if !g.discover {
+			continue
+		}
+
+		match := -1
+		for i, gateway := range found {
+			if g.config.EnvoySerial != "" && gateway.Serial == g.config.EnvoySerial {
+				match = i
+				break
+			}
+		}
+
+		// Without a serial the only gateway on the LAN is taken
+		if g.config.EnvoySerial == "" && discovering == 1 && len(found) == 1 {
+			match = 0
+		}
+
+		if match < 0 {
+			if g.envoyIP() == "" {
+				LogWarning("Gateway %s: no gateway advertising serial %q found via mDNS", g.name, g.config.EnvoySerial)
+			}
+			continue
+		}
+
+		g.setAddress(found[match].Address, addressSourceMDNS)
+	}
+}
+
+// discoveryLoop re-browses periodically to follow DHCP address changes
+func (e *EnvoyExporter) discoveryLoop() {
+	interval := time.Duration(e.config.Discovery.Interval) * time.Second
+	if interval <= 0 {
+		interval = defaultDiscoveryInterval * time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		e.runDiscovery()
+	}
+}
+
+// envoyIP returns the gateway's current address
+func (g *Gateway) envoyIP() string {
+	g.addressMutex.RLock()
+	defer g.addressMutex.RUnlock()
+	return g.address
+}
+
+// setAddress records the gateway's address, dropping the session bound to
+// the old one when it moves
+func (g *Gateway) setAddress(address string, source string) {
+	g.addressMutex.Lock()
+	previous := g.address
+	if previous == address {
+		g.addressMutex.Unlock()
+		return
+	}
+	g.addressMutex.Unlock()
+
+	if previous != "" {
+		// The session cookie belongs to the old host
+		g.resetSession()
+	}
+
+	g.addressMutex.Lock()
+	g.address = address
+	g.addressSource = source
+	if previous != "" {
+		g.addressChanges++
+		g.addressChangedAt = time.Now().Unix()
+	}
+	g.addressMutex.Unlock()
+
+	if previous == "" {
+		LogInfo("Gateway %s: using address %s (%s)", g.name, address, source)
+	} else {
+		LogWarning("Gateway %s: address moved from %s to %s (%s)", g.name, previous, address, source)
+	}
+}
+
+// addressStatus reports the address and how it was obtained
+func (g *Gateway) addressStatus() map[string]interface{} {
+	g.addressMutex.RLock()
+	defer g.addressMutex.RUnlock()
+
+	return map[string]interface{}{
+		"address":      g.address,
+		"source":       g.addressSource,
+		"changes":      g.addressChanges,
+		"last_changed": g.addressChangedAt,
+	}
+}
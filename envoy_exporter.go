@@ -1,13 +1,11 @@
 package main
 
 import (
-	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"net/http"
 	"os"
-	"time"
 )
 
 func NewEnvoyExporter(configFile string) (*EnvoyExporter, error) {
@@ -22,11 +20,24 @@ func NewEnvoyExporter(configFile string) (*EnvoyExporter, error) {
 		return nil, fmt.Errorf("failed to parse config XML: %w", err)
 	}
 
+	// Resolve ${ENV_VAR} and file: references
+	if err := expandConfigSecrets(&config); err != nil {
+		return nil, fmt.Errorf("failed to resolve config value: %w", err)
+	}
+
 	// Set default web directory if not specified
 	if config.WebDir == "" {
 		config.WebDir = "./web"
 	}
 
+	// State holds tokens, so it must not be reachable through the web server
+	if config.StateDir == "" {
+		config.StateDir = "./state"
+	}
+	if err := checkStateDir(config.StateDir, config.WebDir); err != nil {
+		return nil, err
+	}
+
 	// Set default MQTT port if not specified
 	if config.MQTT.Enabled && config.MQTT.Port == 0 {
 		if config.MQTT.TLS {
@@ -36,35 +47,75 @@ func NewEnvoyExporter(configFile string) (*EnvoyExporter, error) {
 		}
 	}
 
-	// Create HTTP client with insecure TLS (for self-signed certs)
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		},
+	applyHTTPDefaults(&config)
+
+	gatewayConfigs, names, err := gatewayConfigs(config)
+	if err != nil {
+		return nil, err
 	}
 
-	exporter := &EnvoyExporter{
-		config:       config,
-		httpClient:   client,
-		metricCache:  make(map[string]float64),
-		queryResults: make(map[string]QueryResult),
+	if err := validateAuthModules(config); err != nil {
+		return nil, err
 	}
 
-	// Get initial token
-	err = exporter.refreshToken()
+	if err := validateQueries(config.Queries); err != nil {
+		return nil, err
+	}
+	if err := validateCalculations(config.CalculatedMetrics.Metrics); err != nil {
+		return nil, err
+	}
+	if err := validateConditions(config.Conditions, config.Queries, config.CalculatedMetrics.Metrics); err != nil {
+		return nil, err
+	}
+	if err := validateTransforms(config.Transforms, config.Queries); err != nil {
+		return nil, err
+	}
+	for i, gatewayConfig := range gatewayConfigs {
+		if err := validateQueries(gatewayConfig.Queries); err != nil {
+			return nil, fmt.Errorf("gateway %s: %w", names[i], err)
+		}
+		if err := validateConditions(gatewayConfig.Conditions, gatewayConfig.Queries, nil); err != nil {
+			return nil, fmt.Errorf("gateway %s: %w", names[i], err)
+		}
+		if err := validateTransforms(gatewayConfig.Transforms, gatewayConfig.Queries); err != nil {
+			return nil, fmt.Errorf("gateway %s: %w", names[i], err)
+		}
+	}
+
+	relabel, err := compileRelabelRules(config.Relabel)
+	if err != nil {
+		return nil, err
+	}
+	mqttRelabel, err := compileRelabelRules(config.MQTT.Relabel)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get initial token: %w", err)
+		return nil, fmt.Errorf("mqtt: %w", err)
 	}
 
-	// Start token refresh goroutine
-	go exporter.tokenRefreshLoop()
+	exporter := &EnvoyExporter{
+		config:      config,
+		relabel:     relabel,
+		mqttRelabel: mqttRelabel,
+	}
 
-	// Start monitor data refresh goroutine
-	go exporter.monitorDataRefreshLoop()
+	for i, gatewayConfig := range gatewayConfigs {
+		gateway, err := newGateway(names[i], names[i], gatewayConfig)
+		if err != nil {
+			return nil, fmt.Errorf("gateway %s: %w", names[i], err)
+		}
+		exporter.gateways = append(exporter.gateways, gateway)
+	}
 
-	// Initialize production tracking
-	exporter.initProductionTracking()
+	// Find gateways configured without an address before logging in
+	if exporter.discoveryEnabled() {
+		exporter.runDiscovery()
+		go exporter.discoveryLoop()
+	}
+
+	for _, gateway := range exporter.gateways {
+		if err := gateway.start(); err != nil {
+			return nil, fmt.Errorf("gateway %s: %w", gateway.name, err)
+		}
+	}
 
 	// Initialize MQTT publisher
 	exporter.initMQTTPublisher()
@@ -72,6 +123,18 @@ func NewEnvoyExporter(configFile string) (*EnvoyExporter, error) {
 	return exporter, nil
 }
 
+// validateQueries checks the parts of a query set that would otherwise only
+// fail once the gateway answers
+func validateQueries(queries []Query) error {
+	if err := validateQueryFormats(queries); err != nil {
+		return err
+	}
+	if err := validateAggregates(queries); err != nil {
+		return err
+	}
+	return validateJSONPaths(queries)
+}
+
 // MQTT Status API endpoint
 func (e *EnvoyExporter) serveMQTTStatusAPI(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -0,0 +1,843 @@
+// envoy_expression.go - Expression language for calculated metrics
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// Expressions are parsed once into a tree and evaluated against an
+// environment that resolves identifiers. Values are numbers, strings or
+// vectors of labelled series (see envoy_vector.go); comparisons and logical
+// operators yield 1 or 0. and, or and not may be written in capitals.
+//
+//	precedence (lowest first):  ?:   || or   && and   == != < <= > >=
+//	                            + -   * / %   unary - + ! not
+//
+// Arithmetic and comparisons apply per series. Series of two vectors pair up
+// by their labels, or only some of them with "a / on(serial) b" or
+// "a / ignoring(phase) b"; a vector holding one series applies to every
+// series of the other side, like a number.
+//
+// Functions: min, max, avg (any number of arguments), abs, round(x) or
+// round(x, digits), clamp(min, max, x), coalesce(a, b, ...) for the first
+// argument that is defined, if(cond, a, b), defined(x) and the functions
+// of conditions in envoy_conditions.go. sum, count and min, max or avg of a
+// single vector aggregate its series, into one or per group with
+// "sum(x) by (type)", "sum by (type) (x)" or "without (serial)".
+type exprNode interface {
+	eval(env exprEnv) (interface{}, error)
+}
+
+// exprEnv resolves an identifier; ok is false when it is not defined
+type exprEnv func(name string) (value interface{}, ok bool)
+
+// undefinedError reports an identifier the environment does not define, so
+// a missing metric is not mistaken for a zero reading
+type undefinedError struct {
+	Name string
+}
+
+func (e *undefinedError) Error() string {
+	return fmt.Sprintf("%q is not defined", e.Name)
+}
+
+var (
+	compiledExpressions      = make(map[string]exprNode)
+	compiledExpressionsMutex sync.RWMutex
+)
+
+// compileExpression parses an expression once and caches the tree
+func compileExpression(text string) (exprNode, error) {
+	compiledExpressionsMutex.RLock()
+	node, ok := compiledExpressions[text]
+	compiledExpressionsMutex.RUnlock()
+	if ok {
+		return node, nil
+	}
+
+	node, err := parseExpression(text)
+	if err != nil {
+		return nil, err
+	}
+
+	compiledExpressionsMutex.Lock()
+	compiledExpressions[text] = node
+	compiledExpressionsMutex.Unlock()
+	return node, nil
+}
+
+// evaluateNumber evaluates an expression that must produce a single number
+func evaluateNumber(text string, env exprEnv) (float64, error) {
+	node, err := compileExpression(text)
+	if err != nil {
+		return math.NaN(), err
+	}
+	number, err := evalNumber(node, env)
+	if err != nil {
+		return math.NaN(), err
+	}
+	return number, nil
+}
+
+// evaluateSeries evaluates an expression producing a number or a vector
+func evaluateSeries(text string, env exprEnv) (interface{}, error) {
+	node, err := compileExpression(text)
+	if err != nil {
+		return nil, err
+	}
+	value, err := node.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	switch value.(type) {
+	case float64, exprVector:
+		return value, nil
+	default:
+		return nil, fmt.Errorf("expression %q produced %q, not a number", text, value)
+	}
+}
+
+// Lexer
+
+type exprToken struct {
+	kind string // "num", "str", "ident", "op" or "eof"
+	text string
+	num  float64
+	pos  int
+}
+
+var exprOperators = []string{"==", "!=", "<=", ">=", "&&", "||", "+", "-", "*", "/", "%", "<", ">", "!", "?", ":", "(", ")", ","}
+
+func lexExpression(text string) ([]exprToken, error) {
+	var tokens []exprToken
+	pos := 0
+	for pos < len(text) {
+		c := rune(text[pos])
+		switch {
+		case unicode.IsSpace(c):
+			pos++
+		case unicode.IsDigit(c) || (c == '.' && pos+1 < len(text) && unicode.IsDigit(rune(text[pos+1]))):
+			end := pos
+			for end < len(text) && (unicode.IsDigit(rune(text[end])) || text[end] == '.') {
+				end++
+			}
+			// Exponent, as in 1e3 or 2.5E-2
+			if end < len(text) && (text[end] == 'e' || text[end] == 'E') {
+				exp := end + 1
+				if exp < len(text) && (text[exp] == '+' || text[exp] == '-') {
+					exp++
+				}
+				if exp < len(text) && unicode.IsDigit(rune(text[exp])) {
+					end = exp
+					for end < len(text) && unicode.IsDigit(rune(text[end])) {
+						end++
+					}
+				}
+			}
+			num, err := strconv.ParseFloat(text[pos:end], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number %q at offset %d", text[pos:end], pos)
+			}
+			tokens = append(tokens, exprToken{kind: "num", text: text[pos:end], num: num, pos: pos})
+			pos = end
+		case c == '_' || unicode.IsLetter(c):
+			end := pos
+			for end < len(text) && (text[end] == '_' || unicode.IsLetter(rune(text[end])) || unicode.IsDigit(rune(text[end]))) {
+				end++
+			}
+			word := text[pos:end]
+			// Conditions have long been written with AND, OR and NOT
+			switch lower := strings.ToLower(word); lower {
+			case "and", "or", "not":
+				word = lower
+			}
+			tokens = append(tokens, exprToken{kind: "ident", text: word, pos: pos})
+			pos = end
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(text[pos+1:], text[pos])
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at offset %d", pos)
+			}
+			tokens = append(tokens, exprToken{kind: "str", text: text[pos+1 : pos+1+end], pos: pos})
+			pos += end + 2
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(text[pos:], op) {
+					tokens = append(tokens, exprToken{kind: "op", text: op, pos: pos})
+					pos += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected %q at offset %d", c, pos)
+			}
+		}
+	}
+	return append(tokens, exprToken{kind: "eof", pos: len(text)}), nil
+}
+
+// Parser
+
+type exprParser struct {
+	text   string
+	tokens []exprToken
+	pos    int
+}
+
+func parseExpression(text string) (exprNode, error) {
+	tokens, err := lexExpression(text)
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", text, err)
+	}
+
+	p := &exprParser{text: text, tokens: tokens}
+	node, err := p.ternary()
+	if err != nil {
+		return nil, fmt.Errorf("expression %q: %w", text, err)
+	}
+	if p.peek().kind != "eof" {
+		return nil, fmt.Errorf("expression %q: unexpected %q at offset %d", text, p.peek().text, p.peek().pos)
+	}
+	return node, nil
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	token := p.tokens[p.pos]
+	if token.kind != "eof" {
+		p.pos++
+	}
+	return token
+}
+
+// accept consumes the next token if it is one of the operators or keywords
+func (p *exprParser) accept(ops ...string) (string, bool) {
+	token := p.peek()
+	if token.kind != "op" && token.kind != "ident" {
+		return "", false
+	}
+	for _, op := range ops {
+		if token.text == op {
+			p.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (p *exprParser) expect(op string) error {
+	if _, ok := p.accept(op); !ok {
+		token := p.peek()
+		if token.kind == "eof" {
+			return fmt.Errorf("expected %q at end", op)
+		}
+		return fmt.Errorf("expected %q at offset %d, found %q", op, token.pos, token.text)
+	}
+	return nil
+}
+
+func (p *exprParser) ternary() (exprNode, error) {
+	cond, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := p.accept("?"); !ok {
+		return cond, nil
+	}
+	then, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.ternary()
+	if err != nil {
+		return nil, err
+	}
+	return &conditionalNode{cond: cond, then: then, otherwise: otherwise}, nil
+}
+
+func (p *exprParser) or() (exprNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("||", "or"); !ok {
+			return left, nil
+		}
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "||", left: left, right: right}
+	}
+}
+
+func (p *exprParser) and() (exprNode, error) {
+	left, err := p.comparison()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if _, ok := p.accept("&&", "and"); !ok {
+			return left, nil
+		}
+		right, err := p.comparison()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "&&", left: left, right: right}
+	}
+}
+
+func (p *exprParser) comparison() (exprNode, error) {
+	left, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	op, ok := p.accept("==", "!=", "<=", ">=", "<", ">")
+	if !ok {
+		return left, nil
+	}
+	matching, err := p.matching()
+	if err != nil {
+		return nil, err
+	}
+	right, err := p.additive()
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{op: op, matching: matching, left: left, right: right}, nil
+}
+
+func (p *exprParser) additive() (exprNode, error) {
+	left, err := p.multiplicative()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("+", "-")
+		if !ok {
+			return left, nil
+		}
+		matching, err := p.matching()
+		if err != nil {
+			return nil, err
+		}
+		right, err := p.multiplicative()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, matching: matching, left: left, right: right}
+	}
+}
+
+func (p *exprParser) multiplicative() (exprNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := p.accept("*", "/", "%")
+		if !ok {
+			return left, nil
+		}
+		matching, err := p.matching()
+		if err != nil {
+			return nil, err
+		}
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op: op, matching: matching, left: left, right: right}
+	}
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	if op, ok := p.accept("-", "+", "!", "not"); ok {
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "not" {
+			op = "!"
+		}
+		return &unaryNode{op: op, operand: operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	token := p.next()
+	switch token.kind {
+	case "num":
+		return &literalNode{value: token.num}, nil
+	case "str":
+		return &literalNode{value: token.text}, nil
+	case "ident":
+		switch token.text {
+		case "true":
+			return &literalNode{value: 1.0}, nil
+		case "false":
+			return &literalNode{value: 0.0}, nil
+		}
+		// Prefix grouping, as in "sum by (type) (x)"
+		if keyword, ok := p.accept("by", "without"); ok {
+			grouping, err := p.grouping(keyword)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("("); err != nil {
+				return nil, err
+			}
+			return p.call(token, grouping)
+		}
+		if _, ok := p.accept("("); ok {
+			return p.call(token, nil)
+		}
+		return &identNode{name: token.text}, nil
+	case "op":
+		if token.text == "(" {
+			node, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return node, nil
+		}
+		return nil, fmt.Errorf("unexpected %q at offset %d", token.text, token.pos)
+	default:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+}
+
+func (p *exprParser) call(name exprToken, grouping *labelGrouping) (exprNode, error) {
+	var args []exprNode
+	if _, ok := p.accept(")"); !ok {
+		for {
+			arg, err := p.ternary()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			if _, ok := p.accept(","); ok {
+				continue
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+
+	// Postfix grouping, as in "sum(x) by (type)"
+	if grouping == nil {
+		if keyword, ok := p.accept("by", "without"); ok {
+			var err error
+			if grouping, err = p.grouping(keyword); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	function, ok := exprFunctions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at offset %d", name.text, name.pos)
+	}
+	if len(args) < function.minArgs || (function.maxArgs >= 0 && len(args) > function.maxArgs) {
+		return nil, fmt.Errorf("%s() takes %s", name.text, function.arity())
+	}
+	if grouping != nil && (function.aggregate == nil || len(args) != 1) {
+		return nil, fmt.Errorf("%s() with %d argument(s) does not aggregate, so it takes no by or without", name.text, len(args))
+	}
+	return &callNode{name: name.text, function: function, args: args, grouping: grouping}, nil
+}
+
+// matching reads an optional on(...) or ignoring(...) after an operator
+func (p *exprParser) matching() (*labelMatching, error) {
+	keyword, ok := p.accept("on", "ignoring")
+	if !ok {
+		return nil, nil
+	}
+	labels, err := p.labelList()
+	if err != nil {
+		return nil, err
+	}
+	return &labelMatching{on: keyword == "on", labels: labels}, nil
+}
+
+// grouping reads the label list after by or without
+func (p *exprParser) grouping(keyword string) (*labelGrouping, error) {
+	labels, err := p.labelList()
+	if err != nil {
+		return nil, err
+	}
+	return &labelGrouping{without: keyword == "without", labels: labels}, nil
+}
+
+func (p *exprParser) labelList() ([]string, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	labels := make([]string, 0)
+	if _, ok := p.accept(")"); ok {
+		return labels, nil
+	}
+	for {
+		token := p.next()
+		if token.kind != "ident" {
+			return nil, fmt.Errorf("expected a label name at offset %d", token.pos)
+		}
+		labels = append(labels, token.text)
+		if _, ok := p.accept(","); ok {
+			continue
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return labels, nil
+	}
+}
+
+// Evaluation
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(env exprEnv) (interface{}, error) {
+	return n.value, nil
+}
+
+type identNode struct {
+	name string
+}
+
+func (n *identNode) eval(env exprEnv) (interface{}, error) {
+	value, ok := env(n.name)
+	if !ok {
+		return nil, &undefinedError{Name: n.name}
+	}
+	switch v := value.(type) {
+	case float64, string, exprVector:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case bool:
+		return truth(v), nil
+	default:
+		return nil, fmt.Errorf("%s is not a number, string or vector", n.name)
+	}
+}
+
+type unaryNode struct {
+	op      string
+	operand exprNode
+}
+
+func (n *unaryNode) eval(env exprEnv) (interface{}, error) {
+	value, err := n.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	return combine([]interface{}{value}, nil, func(args []float64) (float64, error) {
+		switch n.op {
+		case "-":
+			return -args[0], nil
+		case "!":
+			return truth(args[0] == 0), nil
+		default:
+			return args[0], nil
+		}
+	})
+}
+
+type binaryNode struct {
+	op          string
+	matching    *labelMatching
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(env exprEnv) (interface{}, error) {
+	left, err := n.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Strings only compare for equality
+	_, lstr := left.(string)
+	_, rstr := right.(string)
+	if lstr || rstr {
+		switch n.op {
+		case "==":
+			return truth(fmt.Sprint(left) == fmt.Sprint(right)), nil
+		case "!=":
+			return truth(fmt.Sprint(left) != fmt.Sprint(right)), nil
+		}
+		return nil, fmt.Errorf("operator %s needs numbers, got %q and %q", n.op, fmt.Sprint(left), fmt.Sprint(right))
+	}
+
+	return combine([]interface{}{left, right}, n.matching, func(args []float64) (float64, error) {
+		l, r := args[0], args[1]
+		switch n.op {
+		case "+":
+			return l + r, nil
+		case "-":
+			return l - r, nil
+		case "*":
+			return l * r, nil
+		case "/":
+			if r == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return l / r, nil
+		case "%":
+			if r == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return math.Mod(l, r), nil
+		case "==":
+			return truth(l == r), nil
+		case "!=":
+			return truth(l != r), nil
+		case "<":
+			return truth(l < r), nil
+		case "<=":
+			return truth(l <= r), nil
+		case ">":
+			return truth(l > r), nil
+		case ">=":
+			return truth(l >= r), nil
+		}
+		return 0, fmt.Errorf("unknown operator %s", n.op)
+	})
+}
+
+// logicalNode short-circuits, so the right side may reference identifiers
+// that are only defined when the left side holds. An undefined operand
+// counts as false.
+type logicalNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n *logicalNode) eval(env exprEnv) (interface{}, error) {
+	left, err := logicalOperand(n.left, env)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "&&" && left == 0 {
+		return 0.0, nil
+	}
+	if n.op == "||" && left != 0 {
+		return 1.0, nil
+	}
+	right, err := logicalOperand(n.right, env)
+	if err != nil {
+		return nil, err
+	}
+	return truth(right != 0), nil
+}
+
+func logicalOperand(node exprNode, env exprEnv) (float64, error) {
+	value, err := evalNumber(node, env)
+	if _, undefined := err.(*undefinedError); undefined {
+		return 0, nil
+	}
+	return value, err
+}
+
+type conditionalNode struct {
+	cond, then, otherwise exprNode
+}
+
+func (n *conditionalNode) eval(env exprEnv) (interface{}, error) {
+	cond, err := evalNumber(n.cond, env)
+	if err != nil {
+		return nil, err
+	}
+	if cond != 0 {
+		return n.then.eval(env)
+	}
+	return n.otherwise.eval(env)
+}
+
+type callNode struct {
+	name     string
+	function exprFunction
+	args     []exprNode
+	grouping *labelGrouping
+}
+
+func (n *callNode) eval(env exprEnv) (interface{}, error) {
+	if n.function.lazy != nil {
+		return n.function.lazy(n.args, env)
+	}
+
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+
+	if n.function.aggregate != nil && len(args) == 1 {
+		return aggregate(args[0], n.grouping, n.function.aggregate)
+	}
+	return combine(args, nil, func(values []float64) (float64, error) {
+		return n.function.call(values), nil
+	})
+}
+
+type exprFunction struct {
+	minArgs int
+	maxArgs int // -1 for any number
+	call    func(args []float64) float64
+	// aggregate combines the series of a single vector argument
+	aggregate func(values []float64) float64
+	// lazy functions receive their arguments unevaluated
+	lazy func(args []exprNode, env exprEnv) (interface{}, error)
+}
+
+func (f exprFunction) arity() string {
+	switch {
+	case f.maxArgs < 0:
+		return fmt.Sprintf("at least %d argument(s)", f.minArgs)
+	case f.minArgs == f.maxArgs:
+		return fmt.Sprintf("%d argument(s)", f.minArgs)
+	default:
+		return fmt.Sprintf("%d to %d arguments", f.minArgs, f.maxArgs)
+	}
+}
+
+func minOf(values []float64) float64 {
+	result := values[0]
+	for _, value := range values[1:] {
+		result = math.Min(result, value)
+	}
+	return result
+}
+
+func maxOf(values []float64) float64 {
+	result := values[0]
+	for _, value := range values[1:] {
+		result = math.Max(result, value)
+	}
+	return result
+}
+
+func sumOf(values []float64) float64 {
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	return sum
+}
+
+func avgOf(values []float64) float64 {
+	return sumOf(values) / float64(len(values))
+}
+
+var exprFunctions = map[string]exprFunction{
+	"min": {minArgs: 1, maxArgs: -1, call: minOf, aggregate: minOf},
+	"max": {minArgs: 1, maxArgs: -1, call: maxOf, aggregate: maxOf},
+	"avg": {minArgs: 1, maxArgs: -1, call: avgOf, aggregate: avgOf},
+	"sum": {minArgs: 1, maxArgs: 1, aggregate: sumOf},
+	"count": {minArgs: 1, maxArgs: 1, aggregate: func(values []float64) float64 {
+		return float64(len(values))
+	}},
+	"abs": {minArgs: 1, maxArgs: 1, call: func(args []float64) float64 {
+		return math.Abs(args[0])
+	}},
+	"round": {minArgs: 1, maxArgs: 2, call: func(args []float64) float64 {
+		if len(args) == 1 {
+			return math.Round(args[0])
+		}
+		scale := math.Pow(10, math.Round(args[1]))
+		return math.Round(args[0]*scale) / scale
+	}},
+	// clamp(min, max, value), the argument order of the shipped config
+	"clamp": {minArgs: 3, maxArgs: 3, call: func(args []float64) float64 {
+		return math.Max(args[0], math.Min(args[1], args[2]))
+	}},
+	"coalesce": {minArgs: 1, maxArgs: -1, lazy: func(args []exprNode, env exprEnv) (interface{}, error) {
+		var lastErr error
+		for _, arg := range args {
+			value, err := arg.eval(env)
+			if err == nil && !isEmptyVector(value) {
+				return value, nil
+			}
+			if err == nil {
+				err = fmt.Errorf("no series")
+			}
+			lastErr = err
+		}
+		return nil, lastErr
+	}},
+	"if": {minArgs: 3, maxArgs: 3, lazy: func(args []exprNode, env exprEnv) (interface{}, error) {
+		return (&conditionalNode{cond: args[0], then: args[1], otherwise: args[2]}).eval(env)
+	}},
+	"defined": {minArgs: 1, maxArgs: 1, lazy: func(args []exprNode, env exprEnv) (interface{}, error) {
+		value, err := args[0].eval(env)
+		if _, undefined := err.(*undefinedError); undefined {
+			return 0.0, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return truth(!isEmptyVector(value)), nil
+	}},
+	// Reading the item a condition is checked against, see envoy_conditions.go
+	"json_path_exists": {minArgs: 1, maxArgs: 1, lazy: jsonPathExistsFunction},
+	"json_path_value":  {minArgs: 1, maxArgs: 1, lazy: jsonPathValueFunction},
+	"array_has_type":   {minArgs: 1, maxArgs: 1, lazy: arrayHasTypeFunction},
+	"metric_value":     {minArgs: 1, maxArgs: 1, lazy: metricValueFunction},
+}
+
+// evalNumber evaluates a node that must produce one value. A vector holding
+// a single series counts as its value.
+func evalNumber(node exprNode, env exprEnv) (float64, error) {
+	value, err := node.eval(env)
+	if err != nil {
+		return 0, err
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case exprVector:
+		if len(v) == 1 {
+			return v[0].Value, nil
+		}
+		return 0, fmt.Errorf("expected a single value, got %d series", len(v))
+	default:
+		return 0, fmt.Errorf("%q is not a number", value)
+	}
+}
+
+func truth(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func testEnv(values map[string]interface{}) exprEnv {
+	return func(name string) (interface{}, bool) {
+		value, ok := values[name]
+		return value, ok
+	}
+}
+
+func TestEvaluateNumber(t *testing.T) {
+	env := testEnv(map[string]interface{}{
+		"production":  3000.0,
+		"consumption": 2000.0,
+		"zero":        0.0,
+		"count":       4,
+		"enabled":     true,
+		"mode":        "grid",
+	})
+
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"2 * 3 % 4", 2},
+		{"-2 * -3", 6},
+		{"1e3 + 2.5E-1 + .5", 1000.75},
+		{"production - consumption", 1000},
+		{"production / consumption * 100", 150},
+		{"count + enabled", 5},
+		{"production > consumption", 1},
+		{"production <= consumption", 0},
+		{"1 == 1 && 2 != 3", 1},
+		{"1 < 2 || 1 / zero", 1},
+		{"zero > 0 && 1 / zero", 0},
+		{"1 || 0 && 0", 1},
+		{"(1 || 0) && 0", 0},
+		{"!zero", 1},
+		{"not 1", 0},
+		{"1 AND 0 OR 1", 1},
+		{"missing > 0 or production > 0", 1},
+		{"missing > 0 and 1", 0},
+		{"mode == 'grid'", 1},
+		{"mode != \"grid\"", 0},
+		{"production > 0 ? production : 0", 3000},
+		{"zero ? 1 : zero ? 2 : 3", 3},
+		{"min(3, 1, 2)", 1},
+		{"max(production, consumption)", 3000},
+		{"avg(1, 2, 6)", 3},
+		{"abs(consumption - production)", 1000},
+		{"round(2.5)", 3},
+		{"round(2 / 3, 2)", 0.67},
+		{"clamp(0, 100, 150)", 100},
+		{"clamp(0, 100, -5)", 0},
+		{"coalesce(missing, production)", 3000},
+		{"if(zero, 1, 2)", 2},
+		{"defined(missing)", 0},
+		{"defined(production)", 1},
+		{"sum(production)", 3000},
+		{"count(production)", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := evaluateNumber(tt.expr, env)
+			if err != nil {
+				t.Fatalf("evaluateNumber: %v", err)
+			}
+			if math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateNumberErrors(t *testing.T) {
+	env := testEnv(map[string]interface{}{"x": 1.0, "mode": "grid", "object": map[string]interface{}{}})
+
+	tests := []struct {
+		expr      string
+		undefined bool
+	}{
+		{"missing + 1", true},
+		{"1 / 0", false},
+		{"5 % 0", false},
+		{"mode + 1", false},
+		{"mode", false},
+		{"object", false},
+		{"coalesce(missing, other)", true},
+		{"x ? missing : 1", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := evaluateNumber(tt.expr, env)
+			if err == nil {
+				t.Fatalf("evaluateNumber succeeded, want an error")
+			}
+			if _, undefined := err.(*undefinedError); undefined != tt.undefined {
+				t.Errorf("error %v: undefined = %v, want %v", err, undefined, tt.undefined)
+			}
+		})
+	}
+}
+
+func TestCompileExpressionErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"1 +",
+		"(1 + 2",
+		"1 + 2)",
+		"1 2",
+		"x ? 1",
+		"'unterminated",
+		"1 # 2",
+		"nosuch(1)",
+		"abs()",
+		"abs(1, 2)",
+		"clamp(1, 2)",
+		"sum(1, 2)",
+		"sum(x) by",
+		"x / on(a b",
+	}
+	for _, expr := range tests {
+		if _, err := compileExpression(expr); err == nil {
+			t.Errorf("compileExpression(%q) succeeded, want an error", expr)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// envoy_formats.go - Decoding of JSON, XML and text responses into one tree
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatJSON = "json"
+	formatXML  = "xml"
+	formatText = "text"
+)
+
+// responseFormat describes how an endpoint's body is decoded. Every format
+// produces the tree of maps, slices and scalars that json_path walks.
+type responseFormat struct {
+	kind    string
+	pattern *regexp.Regexp // text only
+}
+
+// queryFormat validates a query's format and pattern attributes
+func queryFormat(query Query) (responseFormat, error) {
+	kind := strings.ToLower(strings.TrimSpace(query.Format))
+	switch kind {
+	case "", formatJSON:
+		return responseFormat{kind: formatJSON}, nil
+	case formatXML:
+		return responseFormat{kind: formatXML}, nil
+	case formatText, "regex", "text/regex":
+		if query.Pattern == "" {
+			return responseFormat{}, fmt.Errorf("query %s: format %q needs a pattern", query.Name, query.Format)
+		}
+		pattern, err := regexp.Compile(query.Pattern)
+		if err != nil {
+			return responseFormat{}, fmt.Errorf("query %s: invalid pattern: %w", query.Name, err)
+		}
+		return responseFormat{kind: formatText, pattern: pattern}, nil
+	default:
+		return responseFormat{}, fmt.Errorf("query %s: unknown format %q (json, xml or text)", query.Name, query.Format)
+	}
+}
+
+// validateQueryFormats rejects unknown formats, bad patterns and queries
+// that decode the same URL differently, since each URL is polled once
+func validateQueryFormats(queries []Query) error {
+	seen := make(map[string]Query)
+	for _, query := range queries {
+		if _, err := queryFormat(query); err != nil {
+			return err
+		}
+		if other, ok := seen[query.URL]; ok {
+			if !strings.EqualFold(formatName(other), formatName(query)) || other.Pattern != query.Pattern {
+				return fmt.Errorf("queries %s and %s use the same URL with different formats", other.Name, query.Name)
+			}
+			continue
+		}
+		seen[query.URL] = query
+	}
+	return nil
+}
+
+func formatName(query Query) string {
+	format, err := queryFormat(query)
+	if err != nil {
+		return query.Format
+	}
+	return format.kind
+}
+
+// accept is the Accept header requesting the format
+func (f responseFormat) accept() string {
+	switch f.kind {
+	case formatXML:
+		return "application/xml, text/xml"
+	case formatText:
+		return "text/plain, */*"
+	default:
+		return "application/json"
+	}
+}
+
+// decode parses a response body
+func (f responseFormat) decode(body []byte) (interface{}, error) {
+	switch f.kind {
+	case formatXML:
+		data, err := decodeXML(body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid XML: %w", err)
+		}
+		return data, nil
+	case formatText:
+		return decodeText(f.pattern, string(body)), nil
+	default:
+		var data interface{}
+		if err := json.Unmarshal(body, &data); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		return data, nil
+	}
+}
+
+// xmlNode is an element being decoded
+type xmlNode struct {
+	fields map[string]interface{}
+	text   strings.Builder
+}
+
+// decodeXML turns a document into nested maps. The root element's content
+// is the top of the tree, so <envoy_info><device><sn> is reached as
+// device.sn. Attributes become members alongside child elements, repeated
+// elements become arrays, and elements holding only text become values.
+func decodeXML(body []byte) (interface{}, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+
+	var stack []*xmlNode
+	var names []string
+	var root interface{}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			node := &xmlNode{fields: make(map[string]interface{})}
+			for _, attr := range t.Attr {
+				node.add(attr.Name.Local, textValue(attr.Value))
+			}
+			stack = append(stack, node)
+			names = append(names, t.Name.Local)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(t)
+			}
+		case xml.EndElement:
+			if len(stack) == 0 {
+				continue
+			}
+			node := stack[len(stack)-1]
+			name := names[len(names)-1]
+			stack = stack[:len(stack)-1]
+			names = names[:len(names)-1]
+
+			value := node.value()
+			if len(stack) == 0 {
+				root = value
+			} else {
+				stack[len(stack)-1].add(name, value)
+			}
+		}
+	}
+
+	if root == nil {
+		return nil, fmt.Errorf("no root element")
+	}
+	return root, nil
+}
+
+func (n *xmlNode) add(name string, value interface{}) {
+	existing, ok := n.fields[name]
+	if !ok {
+		n.fields[name] = value
+		return
+	}
+	if list, ok := existing.([]interface{}); ok {
+		n.fields[name] = append(list, value)
+		return
+	}
+	n.fields[name] = []interface{}{existing, value}
+}
+
+// value is the element's members, or its text when it has none
+func (n *xmlNode) value() interface{} {
+	text := strings.TrimSpace(n.text.String())
+	if len(n.fields) == 0 {
+		return textValue(text)
+	}
+	if text != "" {
+		n.fields["text"] = textValue(text)
+	}
+	return n.fields
+}
+
+// decodeText applies a pattern with named groups to a text body. The groups
+// of the first match are members of the top of the tree, and every match is
+// listed under "matches" for array_path="matches".
+func decodeText(pattern *regexp.Regexp, body string) interface{} {
+	tree := map[string]interface{}{}
+	matches := make([]interface{}, 0)
+
+	for i, match := range pattern.FindAllStringSubmatch(body, -1) {
+		groups := make(map[string]interface{})
+		for j, name := range pattern.SubexpNames() {
+			if name == "" || j >= len(match) {
+				continue
+			}
+			groups[name] = textValue(match[j])
+			if i == 0 {
+				tree[name] = groups[name]
+			}
+		}
+		matches = append(matches, groups)
+	}
+
+	tree["matches"] = matches
+	return tree
+}
+
+// textValue types a text node the way JSON would: numbers that read back
+// unchanged become floats and true/false become bools. Anything else, such
+// as a version with leading zeros, stays text.
+func textValue(text string) interface{} {
+	switch text {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil && strconv.FormatFloat(f, 'f', -1, 64) == text {
+		return f
+	}
+	return text
+}
+
+// labelText renders a decoded value as a label. Numbers are written out in
+// full, so a numeric serial or eid does not turn into 1.22012345678e+11.
+func labelText(value interface{}) string {
+	if f, ok := value.(float64); ok {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", value)
+}
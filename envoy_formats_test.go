@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testInfoXML = `<?xml version='1.0' encoding='UTF-8'?>
+<envoy_info>
+  <time>1700000000</time>
+  <device>
+    <sn>122140401234</sn>
+    <pn>800-00555-r03</pn>
+    <software>D7.6.175</software>
+    <imeter>true</imeter>
+  </device>
+  <package name="rootfs"><version>02.00.00</version></package>
+  <package name="kernel"><version>02.00.00</version></package>
+</envoy_info>`
+
+func TestResponseFormatDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		query  Query
+		body   string
+		path   string
+		want   []interface{}
+		errors bool
+	}{
+		{"json", Query{}, `{"a":{"b":[1,2]}}`, "$.a.b[1]", []interface{}{2.0}, false},
+		{"invalid json", Query{}, `<html>`, "", nil, true},
+		{"xml element", Query{Format: "xml"}, testInfoXML, "$.device.sn", []interface{}{122140401234.0}, false},
+		{"xml keeps version text", Query{Format: "xml"}, testInfoXML, "$.device.software", []interface{}{"D7.6.175"}, false},
+		{"xml bool", Query{Format: "xml"}, testInfoXML, "$.device.imeter", []interface{}{true}, false},
+		{"xml repeated elements and attributes", Query{Format: "xml"}, testInfoXML, "$.package[*].name", []interface{}{"rootfs", "kernel"}, false},
+		{"xml leading zeros stay text", Query{Format: "xml"}, testInfoXML, "$.package[0].version", []interface{}{"02.00.00"}, false},
+		{"xml without root", Query{Format: "xml"}, `   `, "", nil, true},
+		{"text first match", Query{Format: "text", Pattern: `(?P<name>\w+)=(?P<value>\d+)`}, "a=1\nb=2", "$.value", []interface{}{1.0}, false},
+		{"text all matches", Query{Format: "text", Pattern: `(?P<name>\w+)=(?P<value>\d+)`}, "a=1\nb=2", "$.matches[*].name", []interface{}{"a", "b"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := queryFormat(tt.query)
+			if err != nil {
+				t.Fatalf("queryFormat: %v", err)
+			}
+			data, err := format.decode([]byte(tt.body))
+			if tt.errors {
+				if err == nil {
+					t.Fatalf("decode succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decode: %v", err)
+			}
+			matches, err := evaluateJSONPath(data, tt.path)
+			if err != nil {
+				t.Fatalf("evaluateJSONPath: %v", err)
+			}
+			var got []interface{}
+			for _, match := range matches {
+				got = append(got, match.Value)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s = %#v, want %#v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueryFormatErrors(t *testing.T) {
+	tests := []Query{
+		{Name: "q", Format: "yaml"},
+		{Name: "q", Format: "text"},
+		{Name: "q", Format: "text", Pattern: "("},
+	}
+	for _, query := range tests {
+		if _, err := queryFormat(query); err == nil {
+			t.Errorf("queryFormat(%q, %q) succeeded, want an error", query.Format, query.Pattern)
+		}
+	}
+
+	conflicting := []Query{{Name: "a", URL: "u"}, {Name: "b", URL: "u", Format: "xml"}}
+	if err := validateQueryFormats(conflicting); err == nil {
+		t.Errorf("validateQueryFormats accepted one URL with two formats")
+	}
+}
+
+func TestDoEnvoyRequestFormats(t *testing.T) {
+	tests := []struct {
+		name         string
+		format       string
+		status       int
+		body         string
+		unauthorized bool
+		errors       bool
+	}{
+		{"xml body", formatXML, http.StatusOK, testInfoXML, false, false},
+		{"xml body mentioning 401", formatXML, http.StatusOK, "<info><sn>401401</sn></info>", false, false},
+		{"text body", formatText, http.StatusOK, "<b>42</b>", false, false},
+		{"json body mentioning 401", formatJSON, http.StatusOK, `{"serial":"401"}`, false, false},
+		{"html error for json", formatJSON, http.StatusOK, "<html>Unauthorized 401</html>", false, true},
+		{"login page", formatXML, http.StatusOK, `<html><form action="/login">login</form></html>`, true, true},
+		{"status 401", formatXML, http.StatusUnauthorized, "", true, true},
+		{"status 500", formatText, http.StatusInternalServerError, "oops", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			g := &Gateway{
+				address:       strings.TrimPrefix(server.URL, "https://"),
+				gatewayClient: server.Client(),
+			}
+			body, _, err := g.doEnvoyRequest(context.Background(), "https://{envoy_ip}/info.xml", responseFormat{kind: tt.format}, "")
+			if got := isUnauthorized(err); got != tt.unauthorized {
+				t.Errorf("unauthorized = %v (%v), want %v", got, err, tt.unauthorized)
+			}
+			if (err != nil) != tt.errors {
+				t.Fatalf("error = %v, want error %v", err, tt.errors)
+			}
+			if err == nil && string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
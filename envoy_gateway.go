@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Name given to the gateway described by the top-level config when no
+// <gateways> section is present. It keeps the original state file names.
+const defaultGatewayName = "default"
+
+// Gateway names end up in file names, MQTT topics and label values
+var gatewayNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// gatewayConfigs returns the per-gateway configs described by the file. Each
+// one is the top-level config with the gateway's own settings applied.
+func gatewayConfigs(config Config) ([]Config, []string, error) {
+	if len(config.Gateways.Gateways) == 0 {
+		// Probe-only deployments have no static gateway
+		if config.EnvoyIP == "" && config.EnvoySerial == "" && len(config.AuthModules.Modules) > 0 {
+			return nil, nil, nil
+		}
+		return []Config{config}, []string{defaultGatewayName}, nil
+	}
+
+	configs := make([]Config, 0, len(config.Gateways.Gateways))
+	names := make([]string, 0, len(config.Gateways.Gateways))
+	seen := make(map[string]bool)
+
+	for i, gc := range config.Gateways.Gateways {
+		if gc.Name == "" {
+			return nil, nil, fmt.Errorf("gateway %d has no name", i+1)
+		}
+		if !gatewayNamePattern.MatchString(gc.Name) {
+			return nil, nil, fmt.Errorf("invalid gateway name %q (letters, digits, '-' and '_' only)", gc.Name)
+		}
+		if seen[gc.Name] {
+			return nil, nil, fmt.Errorf("duplicate gateway name %q", gc.Name)
+		}
+		seen[gc.Name] = true
+
+		// Several gateways found by mDNS can only be told apart by serial
+		derived := applyGatewayConfig(config, gc)
+		if derived.EnvoyIP == "" && derived.EnvoySerial == "" {
+			return nil, nil, fmt.Errorf("gateway %s: envoy_ip or envoy_serial is required", gc.Name)
+		}
+
+		configs = append(configs, derived)
+		names = append(names, gc.Name)
+	}
+
+	return configs, names, nil
+}
+
+// applyGatewayConfig overlays the non-empty gateway settings on the base config
+func applyGatewayConfig(base Config, gc GatewayConfig) Config {
+	config := base
+	config.Gateways = GatewaysConfig{}
+
+	override := func(target *string, value string) {
+		if value != "" {
+			*target = value
+		}
+	}
+	override(&config.EnvoyIP, gc.EnvoyIP)
+	override(&config.EnvoySerial, gc.EnvoySerial)
+	override(&config.User, gc.User)
+	override(&config.Password, gc.Password)
+	override(&config.Token, gc.Token)
+	override(&config.TokenFile, gc.TokenFile)
+	override(&config.TokenEnv, gc.TokenEnv)
+	override(&config.AuthMode, gc.AuthMode)
+	override(&config.DigestUser, gc.DigestUser)
+	override(&config.DigestPassword, gc.DigestPassword)
+
+	if gc.GatewayTLS != (GatewayTLSConfig{}) {
+		config.GatewayTLS = gc.GatewayTLS
+	}
+	if len(gc.Queries) > 0 {
+		config.Queries = gc.Queries
+	}
+
+	return config
+}
+
+// newGateway builds a gateway and its HTTP clients. stateID names its state
+// files in state_dir and is usually the gateway name.
+func newGateway(name string, stateID string, config Config) (*Gateway, error) {
+	// Default to JWT authentication (firmware 7.x and later)
+	if config.AuthMode == "" {
+		config.AuthMode = authModeJWT
+	}
+	switch config.AuthMode {
+	case authModeJWT, authModeDigest, authModeNone:
+	default:
+		return nil, fmt.Errorf("invalid auth_mode %q (expected jwt, digest or none)", config.AuthMode)
+	}
+
+	transforms, err := compileTransforms(config.Transforms)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Gateway{
+		name:              name,
+		stateID:           stateID,
+		config:            config,
+		metricCache:       make(map[string]exprVector),
+		calculationErrors: make(map[string]string),
+		transforms:        transforms,
+		queryResults:      make(map[string]QueryResult),
+		snapshot:          &GatewaySnapshot{Endpoints: make(map[string]*EndpointResult)},
+		stopped:           make(chan struct{}),
+	}
+
+	workers := config.MaxConcurrentQueries
+	if workers <= 0 {
+		workers = defaultMaxConcurrentQueries
+	}
+	g.workers = make(chan struct{}, workers)
+
+	// Separate clients for cloud (login) and LAN (gateway) traffic
+	cloudClient, err := newCloudClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	g.moveLegacyStateFile(tokenStateFileName)
+	g.moveLegacyStateFile(gatewayCertFileName)
+	certVerifier, err := newGatewayCertVerifier(config, g.stateFile(gatewayCertFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	gatewayClient, err := newGatewayClient(config, certVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	g.cloudClient = cloudClient
+	g.gatewayClient = gatewayClient
+	g.certVerifier = certVerifier
+
+	// A configured address always wins over discovery
+	if config.EnvoyIP != "" {
+		g.address = config.EnvoyIP
+		g.addressSource = addressSourceStatic
+	} else {
+		g.discover = true
+	}
+
+	return g, nil
+}
+
+// start obtains the initial token and launches the background loops
+func (g *Gateway) start() error {
+	if err := g.startAuth(); err != nil {
+		return err
+	}
+
+	// Poll the gateway in the background; readers use the snapshots
+	g.startScheduler()
+
+	// Initialize production tracking
+	g.initProductionTracking()
+
+	return nil
+}
+
+// startAuth obtains the initial token and keeps it fresh. Digest and
+// unauthenticated gateways have nothing to manage.
+func (g *Gateway) startAuth() error {
+	// Tokens are only used by JWT firmware
+	if g.config.AuthMode != authModeJWT {
+		LogInfo("Gateway %s: using %s authentication, Envoy token management disabled", g.name, g.config.AuthMode)
+		return nil
+	}
+
+	// Get initial token
+	if err := g.initToken(); err != nil {
+		return fmt.Errorf("failed to get initial token: %w", err)
+	}
+
+	// Start token refresh goroutine
+	go g.tokenRefreshLoop()
+
+	// Watch the token file for rotation
+	if g.config.TokenFile != "" {
+		go g.watchTokenFile()
+	}
+
+	return nil
+}
+
+// stop ends the token loops of a gateway that is no longer used
+func (g *Gateway) stop() {
+	g.stopOnce.Do(func() {
+		close(g.stopped)
+		g.gatewayClient.CloseIdleConnections()
+		g.cloudClient.CloseIdleConnections()
+	})
+}
+
+// sleep waits for d, returning false early if the gateway is stopped
+func (g *Gateway) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-g.stopped:
+		return false
+	}
+}
+
+// stateFile returns the path of a per-gateway file in state_dir
+func (g *Gateway) stateFile(base string) string {
+	return filepath.Join(g.config.StateDir, g.stateFileName(base))
+}
+
+// moveLegacyStateFile moves a state file left in web_dir by an earlier
+// version to state_dir, so it stops being served
+func (g *Gateway) moveLegacyStateFile(base string) {
+	legacy := filepath.Join(g.config.WebDir, g.stateFileName(base))
+	if _, err := os.Stat(legacy); err != nil {
+		return
+	}
+	file := g.stateFile(base)
+	if _, err := os.Stat(file); err == nil {
+		if err := os.Remove(legacy); err != nil {
+			LogWarning("Gateway %s: could not remove stale %s: %v", g.name, legacy, err)
+		}
+		return
+	}
+
+	err := os.MkdirAll(g.config.StateDir, 0700)
+	if err == nil {
+		err = os.Rename(legacy, file)
+	}
+	if err != nil {
+		LogWarning("Gateway %s: could not move %s to %s: %v", g.name, legacy, g.config.StateDir, err)
+		return
+	}
+	LogInfo("Gateway %s: moved %s to %s", g.name, legacy, file)
+}
+
+// checkStateDir rejects a state_dir that is, or is inside, web_dir
+func checkStateDir(stateDir string, webDir string) error {
+	state, err := filepath.Abs(stateDir)
+	if err != nil {
+		return fmt.Errorf("invalid state_dir: %w", err)
+	}
+	web, err := filepath.Abs(webDir)
+	if err != nil {
+		return fmt.Errorf("invalid web_dir: %w", err)
+	}
+	rel, err := filepath.Rel(web, state)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("state_dir %s must not be inside web_dir %s, which is served", stateDir, webDir)
+	}
+	return nil
+}
+
+// stateFileName returns the per-gateway name of a state file. The default
+// gateway keeps the original name.
+func (g *Gateway) stateFileName(base string) string {
+	if g.stateID == defaultGatewayName {
+		return base
+	}
+	ext := filepath.Ext(base)
+	return strings.TrimSuffix(base, ext) + "_" + g.stateID + ext
+}
+
+// labels identifies the gateway on every series it produces
+func (g *Gateway) labels() map[string]string {
+	labels := map[string]string{"gateway": g.name}
+	if g.config.EnvoySerial != "" {
+		labels["gateway_serial"] = g.config.EnvoySerial
+	}
+	return labels
+}
+
+// metricLabels returns the gateway labels plus any extra ones
+func (g *Gateway) metricLabels(extra map[string]string) map[string]string {
+	labels := g.labels()
+	for key, value := range extra {
+		labels[key] = value
+	}
+	return labels
+}
+
+// primaryGateway is used when a request does not name a gateway. It is nil
+// when only /probe targets are configured.
+func (e *EnvoyExporter) primaryGateway() *Gateway {
+	if len(e.gateways) == 0 {
+		return nil
+	}
+	return e.gateways[0]
+}
+
+func (e *EnvoyExporter) primaryEnvoyIP() string {
+	if g := e.primaryGateway(); g != nil {
+		return g.envoyIP()
+	}
+	return ""
+}
+
+func (e *EnvoyExporter) findGateway(name string) *Gateway {
+	for _, g := range e.gateways {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// requestGateway resolves the optional ?gateway= parameter, answering 404
+// for unknown names or when no gateway is configured
+func (e *EnvoyExporter) requestGateway(w http.ResponseWriter, r *http.Request) (*Gateway, bool) {
+	name := r.URL.Query().Get("gateway")
+	g := e.primaryGateway()
+	if name != "" {
+		g = e.findGateway(name)
+	}
+	if g == nil && name == "" {
+		http.Error(w, "No gateway configured", http.StatusNotFound)
+		return nil, false
+	}
+	if g == nil {
+		http.Error(w, fmt.Sprintf("Unknown gateway %q", name), http.StatusNotFound)
+		return nil, false
+	}
+	return g, true
+}
+
+func (e *EnvoyExporter) gatewayNames() []string {
+	names := make([]string, 0, len(e.gateways))
+	for _, g := range e.gateways {
+		names = append(names, g.name)
+	}
+	return names
+}
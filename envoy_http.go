@@ -0,0 +1,105 @@
+// envoy_http.go - HTTP clients for Enlighten (cloud) and gateway (LAN) traffic
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Defaults for the cloud login flow and gateway requests
+const (
+	defaultEnlightenURL   = "https://enlighten.enphaseenergy.com"
+	defaultEntrezURL      = "https://entrez.enphaseenergy.com"
+	defaultCloudTimeout   = 30 // seconds
+	defaultGatewayTimeout = 30 // seconds
+	cloudProxyEnvironment = "environment"
+)
+
+// applyHTTPDefaults fills in unset cloud and gateway settings
+func applyHTTPDefaults(config *Config) {
+	if config.Cloud.EnlightenURL == "" {
+		config.Cloud.EnlightenURL = defaultEnlightenURL
+	}
+	if config.Cloud.EntrezURL == "" {
+		config.Cloud.EntrezURL = defaultEntrezURL
+	}
+	config.Cloud.EnlightenURL = strings.TrimRight(config.Cloud.EnlightenURL, "/")
+	config.Cloud.EntrezURL = strings.TrimRight(config.Cloud.EntrezURL, "/")
+
+	if config.Cloud.Timeout <= 0 {
+		config.Cloud.Timeout = defaultCloudTimeout
+	}
+	if config.GatewayTimeout <= 0 {
+		config.GatewayTimeout = defaultGatewayTimeout
+	}
+}
+
+// newCloudClient creates the client used for the Enlighten login and entrez
+// token requests, routed through the configured proxy
+func newCloudClient(config Config) (*http.Client, error) {
+	// Enlighten has a public certificate, so use standard verification
+	transport := &http.Transport{
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+
+	switch proxy := config.Cloud.Proxy; proxy {
+	case "":
+		// Direct connection
+	case cloudProxyEnvironment:
+		transport.Proxy = http.ProxyFromEnvironment
+	default:
+		// The proxy URL may carry credentials, so it is never echoed back
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cloud proxy URL")
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5", "socks5h":
+		default:
+			return nil, fmt.Errorf("unsupported cloud proxy scheme %q (expected http, https or socks5)", proxyURL.Scheme)
+		}
+		LogInfo("Routing Enlighten login through proxy %s", proxyURL.Redacted())
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{
+		Timeout:   time.Duration(config.Cloud.Timeout) * time.Second,
+		Transport: transport,
+	}, nil
+}
+
+// newGatewayClient creates the client used for requests to the Envoy on the
+// LAN. It never uses a proxy, verifies the gateway certificate with the
+// given verifier and keeps the sessionId cookie in its jar.
+func newGatewayClient(config Config, verifier *gatewayCertVerifier) (*http.Client, error) {
+	// Cookie jar holds the Envoy sessionId cookie
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cookie jar: %w", err)
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		TLSClientConfig:     verifier.tlsConfig(),
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConnsPerHost: 4,
+	}
+
+	// Legacy firmware answers with digest challenges instead of using tokens
+	if config.AuthMode == authModeDigest {
+		user, password, err := digestCredentials(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up digest auth: %w", err)
+		}
+		transport = newDigestTransport(transport, user, password)
+	}
+
+	return &http.Client{
+		Timeout:   time.Duration(config.GatewayTimeout) * time.Second,
+		Jar:       jar,
+		Transport: transport,
+	}, nil
+}
@@ -0,0 +1,647 @@
+// envoy_jsonpath.go - JSONPath evaluation over decoded responses
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A path is a sequence of steps, each mapping a set of nodes to a new set:
+//
+//	key          .name  ['name']
+//	index        [2]  [-1] (from the end)
+//	wildcard     .*  [*]
+//	descent      ..name  ..*  ..[0]  (the step applied at every depth)
+//	filter       [?(@.type == 'eim' && @.activeCount > 0)]
+//
+// The leading $ is optional, so plain dotted paths keep working.
+type pathStep struct {
+	kind      int
+	key       string
+	index     int
+	filter    *pathFilter
+	recursive bool
+}
+
+const (
+	stepKey = iota
+	stepIndex
+	stepWildcard
+	stepFilter
+)
+
+// jsonPathMatch is one node selected by a path, with the nodes above it
+// (outermost first) so sibling and parent fields can be read
+type jsonPathMatch struct {
+	Value     interface{}
+	Ancestors []interface{}
+}
+
+// parent returns the object or array holding the node, or nil at the root
+func (m jsonPathMatch) parent() interface{} {
+	if len(m.Ancestors) == 0 {
+		return nil
+	}
+	return m.Ancestors[len(m.Ancestors)-1]
+}
+
+// child returns a match for a node directly below this one
+func (m jsonPathMatch) child(value interface{}) jsonPathMatch {
+	ancestors := make([]interface{}, len(m.Ancestors), len(m.Ancestors)+1)
+	copy(ancestors, m.Ancestors)
+	return jsonPathMatch{Value: value, Ancestors: append(ancestors, m.Value)}
+}
+
+var (
+	compiledPaths      = make(map[string][]pathStep)
+	compiledPathsMutex sync.RWMutex
+)
+
+// compileJSONPath parses a path once and caches the steps
+func compileJSONPath(path string) ([]pathStep, error) {
+	compiledPathsMutex.RLock()
+	steps, ok := compiledPaths[path]
+	compiledPathsMutex.RUnlock()
+	if ok {
+		return steps, nil
+	}
+
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	compiledPathsMutex.Lock()
+	compiledPaths[path] = steps
+	compiledPathsMutex.Unlock()
+	return steps, nil
+}
+
+// validateJSONPaths rejects field paths that cannot be parsed, so mistakes
+// show up at startup rather than as missing series
+func validateJSONPaths(queries []Query) error {
+	for _, query := range queries {
+		for _, metric := range query.Metrics {
+			for _, field := range metric.Fields {
+				paths := []string{field.JSONPath}
+				if field.Transform == "signal_strength_percentage" {
+					paths = strings.Split(field.JSONPath, ",")
+				}
+				for _, path := range paths {
+					if path == "" && field.LabelValue != "" {
+						continue
+					}
+					_, path = parentPath(path)
+					if _, err := compileJSONPath(path); err != nil {
+						return fmt.Errorf("query %s, metric %s: %w", query.Name, metric.Name, err)
+					}
+				}
+			}
+			if metric.ArrayPath != "" {
+				if _, err := compileJSONPath(metric.ArrayPath); err != nil {
+					return fmt.Errorf("query %s, metric %s: array_path: %w", query.Name, metric.Name, err)
+				}
+			}
+		}
+		if query.ArrayPath != "" {
+			if _, err := compileJSONPath(query.ArrayPath); err != nil {
+				return fmt.Errorf("query %s: array_path: %w", query.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// parentPath splits the leading ^ marks off a label path: "^.type" is the
+// type of the object enclosing the item, "^^.type" one further up
+func parentPath(path string) (int, string) {
+	levels := 0
+	for levels < len(path) && path[levels] == '^' {
+		levels++
+	}
+	return levels, path[levels:]
+}
+
+// enclosingObject returns the levels-th object above a node, skipping the
+// arrays in between, or nil when there is none
+func enclosingObject(match jsonPathMatch, levels int) interface{} {
+	for i := len(match.Ancestors) - 1; i >= 0; i-- {
+		if _, ok := match.Ancestors[i].([]interface{}); ok {
+			continue
+		}
+		levels--
+		if levels == 0 {
+			return match.Ancestors[i]
+		}
+	}
+	return nil
+}
+
+func parseJSONPath(path string) ([]pathStep, error) {
+	path = strings.TrimSpace(path)
+	pos := 0
+	if strings.HasPrefix(path, "$") || strings.HasPrefix(path, "@") {
+		pos = 1
+	}
+
+	var steps []pathStep
+	for pos < len(path) {
+		recursive := false
+		switch {
+		case strings.HasPrefix(path[pos:], ".."):
+			recursive = true
+			pos += 2
+		case path[pos] == '.':
+			pos++
+		case path[pos] == '[':
+		case pos == 0:
+			// A bare leading name, as in "meters.pv"
+		default:
+			return nil, fmt.Errorf("json_path %q: unexpected %q at offset %d", path, path[pos], pos)
+		}
+
+		if pos >= len(path) {
+			return nil, fmt.Errorf("json_path %q: missing name at end", path)
+		}
+
+		var step pathStep
+		switch {
+		case path[pos] == '[':
+			end, err := closingBracket(path, pos)
+			if err != nil {
+				return nil, err
+			}
+			step, err = parseBracket(path, path[pos+1:end])
+			if err != nil {
+				return nil, err
+			}
+			pos = end + 1
+		case path[pos] == '*':
+			step = pathStep{kind: stepWildcard}
+			pos++
+		default:
+			end := pos
+			for end < len(path) && path[end] != '.' && path[end] != '[' {
+				end++
+			}
+			if end == pos {
+				return nil, fmt.Errorf("json_path %q: empty name at offset %d", path, pos)
+			}
+			step = pathStep{kind: stepKey, key: path[pos:end]}
+			pos = end
+		}
+
+		step.recursive = recursive
+		steps = append(steps, step)
+	}
+
+	return steps, nil
+}
+
+// closingBracket finds the ] matching the [ at start, skipping quoted text
+// and nested brackets inside filters
+func closingBracket(path string, start int) (int, error) {
+	depth := 0
+	var quote byte
+	for i := start; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("json_path %q: unterminated [", path)
+}
+
+func parseBracket(path string, content string) (pathStep, error) {
+	content = strings.TrimSpace(content)
+
+	switch {
+	case content == "*":
+		return pathStep{kind: stepWildcard}, nil
+	case strings.HasPrefix(content, "?"):
+		expr := strings.TrimSpace(content[1:])
+		if !strings.HasPrefix(expr, "(") || closingParen(expr) != len(expr)-1 {
+			return pathStep{}, fmt.Errorf("json_path %q: filter must be written [?(...)]", path)
+		}
+		filter, err := parsePathFilter(expr[1 : len(expr)-1])
+		if err != nil {
+			return pathStep{}, fmt.Errorf("json_path %q: %w", path, err)
+		}
+		return pathStep{kind: stepFilter, filter: filter}, nil
+	case len(content) >= 2 && (content[0] == '\'' || content[0] == '"') && content[len(content)-1] == content[0]:
+		return pathStep{kind: stepKey, key: content[1 : len(content)-1]}, nil
+	default:
+		index, err := strconv.Atoi(content)
+		if err != nil {
+			return pathStep{}, fmt.Errorf("json_path %q: invalid subscript [%s]", path, content)
+		}
+		return pathStep{kind: stepIndex, index: index}, nil
+	}
+}
+
+// evaluateJSONPath returns every node the path selects, in document order.
+// Object members are visited in key order so series are stable.
+func evaluateJSONPath(data interface{}, path string) ([]jsonPathMatch, error) {
+	return evaluateJSONPathFrom(jsonPathMatch{Value: data}, path)
+}
+
+// evaluateJSONPathFrom applies a path below an already selected node; the
+// results keep that node's ancestors
+func evaluateJSONPathFrom(start jsonPathMatch, path string) ([]jsonPathMatch, error) {
+	steps, err := compileJSONPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if start.Value == nil {
+		return nil, nil
+	}
+
+	return applySteps(start, steps), nil
+}
+
+func applySteps(start jsonPathMatch, steps []pathStep) []jsonPathMatch {
+	current := []jsonPathMatch{start}
+	for _, step := range steps {
+		var next []jsonPathMatch
+		for _, match := range current {
+			if step.recursive {
+				descend(match, func(m jsonPathMatch) {
+					next = append(next, applyStep(step, m)...)
+				})
+			} else {
+				next = append(next, applyStep(step, match)...)
+			}
+		}
+		current = next
+		if len(current) == 0 {
+			break
+		}
+	}
+	return current
+}
+
+// descend visits a node and everything below it
+func descend(match jsonPathMatch, visit func(jsonPathMatch)) {
+	visit(match)
+	for _, child := range children(match) {
+		descend(child, visit)
+	}
+}
+
+// children lists the members of an object (by key) or the items of an array
+func children(match jsonPathMatch) []jsonPathMatch {
+	switch v := match.Value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		matches := make([]jsonPathMatch, 0, len(keys))
+		for _, key := range keys {
+			matches = append(matches, match.child(v[key]))
+		}
+		return matches
+	case []interface{}:
+		matches := make([]jsonPathMatch, 0, len(v))
+		for _, item := range v {
+			matches = append(matches, match.child(item))
+		}
+		return matches
+	default:
+		return nil
+	}
+}
+
+func applyStep(step pathStep, match jsonPathMatch) []jsonPathMatch {
+	switch step.kind {
+	case stepKey:
+		if value, ok := memberValue(match.Value, step.key); ok {
+			return []jsonPathMatch{match.child(value)}
+		}
+	case stepIndex:
+		if arr, ok := match.Value.([]interface{}); ok {
+			index := step.index
+			if index < 0 {
+				index += len(arr)
+			}
+			if index >= 0 && index < len(arr) {
+				return []jsonPathMatch{match.child(arr[index])}
+			}
+		}
+	case stepWildcard:
+		return children(match)
+	case stepFilter:
+		var matches []jsonPathMatch
+		for _, child := range children(match) {
+			if step.filter.matches(child.Value) {
+				matches = append(matches, child)
+			}
+		}
+		return matches
+	}
+	return nil
+}
+
+// memberValue reads a key from an object. Structs are matched on their
+// exported field names.
+func memberValue(node interface{}, key string) (interface{}, bool) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		value, ok := v[key]
+		return value, ok && value != nil
+	case []interface{}, nil:
+		return nil, false
+	}
+
+	val := reflect.ValueOf(node)
+	if val.Kind() == reflect.Ptr {
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct {
+		return nil, false
+	}
+	field := val.FieldByName(strings.Title(key))
+	if !field.IsValid() {
+		return nil, false
+	}
+	return field.Interface(), true
+}
+
+// pathFilter is a predicate over one candidate node (@). Terms are joined by
+// && and ||, with && binding tighter; parentheses group terms.
+type pathFilter struct {
+	any [][]filterTerm // OR of AND groups
+}
+
+// filterTerm is "@.path", "!@.path", "@.path <op> operand" or a
+// parenthesized filter, optionally negated
+type filterTerm struct {
+	left    []pathStep
+	group   *pathFilter
+	negate  bool
+	op      string
+	operand interface{} // literal, or []pathStep for another @ path
+}
+
+var filterOperators = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+func parsePathFilter(expr string) (*pathFilter, error) {
+	filter := &pathFilter{}
+	for _, group := range splitTopLevel(expr, "||") {
+		var terms []filterTerm
+		for _, text := range splitTopLevel(group, "&&") {
+			term, err := parseFilterTerm(strings.TrimSpace(text))
+			if err != nil {
+				return nil, err
+			}
+			terms = append(terms, term)
+		}
+		filter.any = append(filter.any, terms)
+	}
+	return filter, nil
+}
+
+func parseFilterTerm(text string) (filterTerm, error) {
+	var term filterTerm
+	if text == "" {
+		return term, fmt.Errorf("empty filter term")
+	}
+	if strings.HasPrefix(text, "!") {
+		term.negate = true
+		text = strings.TrimSpace(text[1:])
+	}
+
+	if strings.HasPrefix(text, "(") {
+		end := closingParen(text)
+		if end < 0 {
+			return term, fmt.Errorf("filter term %q: unbalanced parentheses", text)
+		}
+		if end != len(text)-1 {
+			return term, fmt.Errorf("filter term %q: unexpected %q after )", text, strings.TrimSpace(text[end+1:]))
+		}
+		group, err := parsePathFilter(text[1:end])
+		if err != nil {
+			return term, err
+		}
+		term.group = group
+		return term, nil
+	}
+	if indexTopLevel(text, "(") >= 0 || indexTopLevel(text, ")") >= 0 {
+		return term, fmt.Errorf("filter term %q: unbalanced parentheses", text)
+	}
+
+	left, op, right := text, "", ""
+	for _, candidate := range filterOperators {
+		if i := indexTopLevel(text, candidate); i >= 0 {
+			left, op, right = text[:i], candidate, text[i+len(candidate):]
+			break
+		}
+	}
+
+	left = strings.TrimSpace(left)
+	if !strings.HasPrefix(left, "@") {
+		return term, fmt.Errorf("filter term %q must start with @", text)
+	}
+	steps, err := parseJSONPath(left)
+	if err != nil {
+		return term, err
+	}
+	term.left = steps
+
+	if op == "" {
+		return term, nil
+	}
+	if term.negate {
+		return term, fmt.Errorf("filter term %q: ! only applies to existence tests", text)
+	}
+	term.op = op
+
+	right = strings.TrimSpace(right)
+	switch {
+	case strings.HasPrefix(right, "@"):
+		operand, err := parseJSONPath(right)
+		if err != nil {
+			return term, err
+		}
+		term.operand = operand
+	case len(right) >= 2 && (right[0] == '\'' || right[0] == '"') && right[len(right)-1] == right[0]:
+		term.operand = right[1 : len(right)-1]
+	case right == "true" || right == "false":
+		term.operand = right == "true"
+	case right == "null":
+		term.operand = nil
+	default:
+		number, err := strconv.ParseFloat(right, 64)
+		if err != nil {
+			return term, fmt.Errorf("filter term %q: invalid operand %q", text, right)
+		}
+		term.operand = number
+	}
+
+	return term, nil
+}
+
+func (f *pathFilter) matches(node interface{}) bool {
+	for _, group := range f.any {
+		all := true
+		for _, term := range group {
+			if !term.matches(node) {
+				all = false
+				break
+			}
+		}
+		if all {
+			return true
+		}
+	}
+	return false
+}
+
+func (t filterTerm) matches(node interface{}) bool {
+	if t.group != nil {
+		return t.group.matches(node) != t.negate
+	}
+
+	left, found := firstMatch(node, t.left)
+	if t.op == "" {
+		return found != t.negate
+	}
+
+	right := t.operand
+	if steps, ok := t.operand.([]pathStep); ok {
+		right, _ = firstMatch(node, steps)
+	}
+
+	return compareValues(left, t.op, right)
+}
+
+// firstMatch applies compiled steps to a node and returns the first result
+func firstMatch(node interface{}, steps []pathStep) (interface{}, bool) {
+	matches := applySteps(jsonPathMatch{Value: node}, steps)
+	if len(matches) == 0 {
+		return nil, false
+	}
+	return matches[0].Value, true
+}
+
+// compareValues compares numbers numerically and everything else by its
+// text; ordering comparisons need two numbers
+func compareValues(left interface{}, op string, right interface{}) bool {
+	l, lok := left.(float64)
+	r, rok := right.(float64)
+	if lok && rok {
+		switch op {
+		case "==":
+			return l == r
+		case "!=":
+			return l != r
+		case "<":
+			return l < r
+		case "<=":
+			return l <= r
+		case ">":
+			return l > r
+		case ">=":
+			return l >= r
+		}
+		return false
+	}
+
+	equal := fmt.Sprintf("%v", left) == fmt.Sprintf("%v", right)
+	if left == nil || right == nil {
+		equal = left == nil && right == nil
+	}
+	switch op {
+	case "==":
+		return equal
+	case "!=":
+		return !equal
+	default:
+		return false
+	}
+}
+
+// splitTopLevel splits on sep where it does not appear in a quoted string
+// or inside parentheses or brackets
+func splitTopLevel(text string, sep string) []string {
+	var parts []string
+	for {
+		i := indexTopLevel(text, sep)
+		if i < 0 {
+			return append(parts, text)
+		}
+		parts = append(parts, text[:i])
+		text = text[i+len(sep):]
+	}
+}
+
+// indexTopLevel finds sep outside quoted strings, parentheses and brackets.
+// An opening or unmatched closing parenthesis is itself at the top level.
+func indexTopLevel(text string, sep string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			continue
+		case depth == 0 && strings.HasPrefix(text[i:], sep):
+			return i
+		}
+		switch c {
+		case '\'', '"':
+			quote = c
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		}
+	}
+	return -1
+}
+
+// closingParen returns the index of the ) matching the ( that text starts
+// with, or -1
+func closingParen(text string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
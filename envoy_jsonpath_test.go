@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testJSONPathDocument = `{
+	"production": [
+		{"type": "inverters", "activeCount": 12, "wNow": 2500},
+		{"type": "eim", "measurementType": "production", "activeCount": 1, "wNow": 2450.5},
+		{"type": "eim", "measurementType": "total-consumption", "activeCount": 0}
+	],
+	"meters": {"pv": {"watts": 1200}, "grid": {"watts": -300}},
+	"name": "envoy",
+	"items": [
+		{"a": 1, "b": 5, "c": false, "tag": "x||y"},
+		{"a": 2, "b": 2, "c": true},
+		{"a": 1, "b": 2, "c": true, "min": 1, "max": 3}
+	]
+}`
+
+func testDocument(t *testing.T, text string) interface{} {
+	t.Helper()
+	var data interface{}
+	if err := json.Unmarshal([]byte(text), &data); err != nil {
+		t.Fatalf("invalid test document: %v", err)
+	}
+	return data
+}
+
+func TestEvaluateJSONPath(t *testing.T) {
+	data := testDocument(t, testJSONPathDocument)
+
+	tests := []struct {
+		path string
+		want []interface{}
+	}{
+		{"name", []interface{}{"envoy"}},
+		{"$.name", []interface{}{"envoy"}},
+		{"meters.pv.watts", []interface{}{1200.0}},
+		{"$['meters'][\"grid\"].watts", []interface{}{-300.0}},
+		{"$.production[0].activeCount", []interface{}{12.0}},
+		{"$.production[-1].measurementType", []interface{}{"total-consumption"}},
+		{"$.production[5]", nil},
+		{"$.meters.*.watts", []interface{}{-300.0, 1200.0}},
+		{"$.production[*].type", []interface{}{"inverters", "eim", "eim"}},
+		{"$..watts", []interface{}{-300.0, 1200.0}},
+		{"$.missing.watts", nil},
+		{"$.production[?(@.type == 'eim')].activeCount", []interface{}{1.0, 0.0}},
+		{"$.production[?(@.type == 'eim' && @.activeCount > 0)].wNow", []interface{}{2450.5}},
+		{"$.production[?(@.activeCount == 0 || @.type == 'inverters')].type", []interface{}{"inverters", "eim"}},
+		{"$.production[?(@.measurementType)].activeCount", []interface{}{1.0, 0.0}},
+		{"$.production[?(!@.measurementType)].type", []interface{}{"inverters"}},
+		{"$.production[?(@.wNow >= 2500)].type", []interface{}{"inverters"}},
+		{"$.production[?(@.type != \"eim\")].type", []interface{}{"inverters"}},
+		{"$.items[?(@.tag == 'x||y')].a", []interface{}{1.0}},
+		{"$.items[?(@.a < @.b)].b", []interface{}{5.0, 2.0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			matches, err := evaluateJSONPath(data, tt.path)
+			if err != nil {
+				t.Fatalf("evaluateJSONPath: %v", err)
+			}
+			var got []interface{}
+			for _, match := range matches {
+				got = append(got, match.Value)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathFilterGrouping(t *testing.T) {
+	items := testDocument(t, `[{"a":1,"b":0,"c":false},{"a":0,"b":2,"c":false},{"a":0,"b":2,"c":true},{"a":0,"b":0,"c":true}]`)
+
+	tests := []struct {
+		filter string
+		want   int // matching items
+	}{
+		{"@.a == 1 || @.b == 2 && @.c == true", 2},
+		{"(@.a == 1 || @.b == 2) && @.c == true", 1},
+		{"((@.a == 1 || @.b == 2) && @.c == true)", 1},
+		{"@.c == true && (@.a == 1 || @.b == 2)", 1},
+		{"!(@.a == 1 || @.b == 2)", 1},
+		{"(@.a == 1) || (@.c == true)", 3},
+		{"((@.a == 1))", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			matches, err := evaluateJSONPath(items, "$[?("+tt.filter+")]")
+			if err != nil {
+				t.Fatalf("evaluateJSONPath: %v", err)
+			}
+			if len(matches) != tt.want {
+				t.Errorf("%d matches, want %d", len(matches), tt.want)
+			}
+		})
+	}
+
+	// a == 1 alone must not satisfy the group
+	data := testDocument(t, `[{"a":1,"c":false},{"b":3,"c":true}]`)
+	matches, err := evaluateJSONPath(data, "$[?((@.a == 1 || @.b == 2) && @.c == true)]")
+	if err != nil {
+		t.Fatalf("evaluateJSONPath: %v", err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("%d matches, want 0", len(matches))
+	}
+}
+
+func TestParseJSONPathErrors(t *testing.T) {
+	tests := []string{
+		"$.a.",
+		"$.a[1",
+		"$.a[x]",
+		"$.a..",
+		"$[?@.a == 1]",
+		"$[?(a == 1)]",
+		"$[?(@.a == )]",
+		"$[?(!@.a == 1)]",
+		"$[?((@.a == 1)]",
+		"$[?(@.a == 1))]",
+		"$[?((@.a == 1) @.b)]",
+		"$[?(@.a == 1 && )]",
+	}
+	for _, path := range tests {
+		if _, err := parseJSONPath(path); err == nil {
+			t.Errorf("parseJSONPath(%q) succeeded, want an error", path)
+		}
+	}
+}
+
+func TestItemFilter(t *testing.T) {
+	item := testDocument(t, `{"a":1,"b":2,"c":true}`)
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{"@.a == 1", true},
+		{"(@.a == 2 || @.b == 2) && @.c == true", true},
+		{"(@.a == 2 || @.b == 2) && @.c == false", false},
+		{"@.a == 2 || (@.b == 2 && @.c == false)", false},
+	}
+	for _, tt := range tests {
+		filter, err := itemFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("itemFilter(%q): %v", tt.filter, err)
+		}
+		if got := filter.matches(item); got != tt.want {
+			t.Errorf("itemFilter(%q) = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	if _, err := itemFilter("(@.a == 1"); err == nil {
+		t.Errorf("itemFilter accepted an unbalanced filter")
+	}
+}
@@ -0,0 +1,69 @@
+// envoy_jwt.go - Envoy JWT claim decoding
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Token scopes reported by the enphaseUser claim
+const (
+	tokenScopeOwner     = "owner"
+	tokenScopeInstaller = "installer"
+	tokenScopeUnknown   = "unknown"
+)
+
+// parseEnvoyToken decodes the claims of an Envoy JWT. The signature is not
+// verified; the gateway does that, we only need the expiry and scope.
+func parseEnvoyToken(token string) (*EnvoyTokenClaims, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token is not a JWT (expected 3 segments, got %d)", len(parts))
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode JWT payload: %w", err)
+	}
+
+	var claims EnvoyTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to parse JWT claims: %w", err)
+	}
+
+	return &claims, nil
+}
+
+// GatewaySerial returns the gateway serial the token was issued for. Entrez
+// puts it in the audience claim; some tokens carry an explicit serial claim.
+func (c *EnvoyTokenClaims) GatewaySerial() string {
+	if c.Serial != "" {
+		return c.Serial
+	}
+
+	var aud string
+	if err := json.Unmarshal(c.Audience, &aud); err == nil {
+		return aud
+	}
+
+	var audList []string
+	if err := json.Unmarshal(c.Audience, &audList); err == nil && len(audList) > 0 {
+		return audList[0]
+	}
+
+	return ""
+}
+
+// Scope returns the token scope (owner or installer)
+func (c *EnvoyTokenClaims) Scope() string {
+	switch strings.ToLower(c.EnphaseUser) {
+	case tokenScopeOwner:
+		return tokenScopeOwner
+	case tokenScopeInstaller:
+		return tokenScopeInstaller
+	default:
+		return tokenScopeUnknown
+	}
+}
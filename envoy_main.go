@@ -56,9 +56,11 @@ func main() {
 		sig := <-sigChan
 		LogInfo("Received signal %v, shutting down gracefully...", sig)
 		
-		// Shutdown production tracker
-		if exporter.productionTracker != nil {
-			exporter.productionTracker.Shutdown()
+		// Shutdown production trackers
+		for _, gateway := range exporter.gateways {
+			if gateway.productionTracker != nil {
+				gateway.productionTracker.Shutdown()
+			}
 		}
 		
 		// Shutdown MQTT publisher
@@ -80,7 +82,8 @@ func main() {
 	}
 
 	// Set up HTTP routes
-	http.HandleFunc("/metrics", exporter.serveMetrics)
+	http.Handle("/metrics", exporter.metricsHandler())
+	http.HandleFunc("/probe", exporter.serveProbe)
 	http.HandleFunc("/health", exporter.serveHealth)
 	http.HandleFunc("/debug", exporter.serveDebug)
 	http.HandleFunc("/api/monitor", exporter.serveMonitorAPI)
@@ -102,7 +105,9 @@ func main() {
 	LogInfo("Built: %s by %s@%s", buildInfo.BuildTime, buildInfo.BuildUser, buildInfo.BuildHost)
 	LogInfo("Go: %s (%s)", buildInfo.GoRuntime, buildInfo.Platform)
 	LogInfo("Listening on: %s", listenAddr)
-	LogInfo("Envoy IP: %s", exporter.config.EnvoyIP)
+	for _, gateway := range exporter.gateways {
+		LogInfo("Envoy gateway %s: %s", gateway.name, gateway.envoyIP())
+	}
 	LogInfo("Web Directory: %s", exporter.config.WebDir)
 	LogInfo("Location: %.6f, %.6f", exporter.config.Latitude, exporter.config.Longitude)
 	LogInfo("Production tracking enabled")
@@ -20,6 +20,7 @@ type MQTTPublisher struct {
 	mutex        sync.RWMutex
 	lastPublish  int64
 	shutdown     chan struct{}
+	relabel      relabelRules
 }
 
 // Default MQTT metrics to publish
@@ -61,6 +62,7 @@ func (e *EnvoyExporter) initMQTTPublisher() {
 	publisher := &MQTTPublisher{
 		config:   e.config.MQTT,
 		shutdown: make(chan struct{}),
+		relabel:  e.mqttRelabel,
 	}
 
 	// Create MQTT client options
@@ -157,10 +159,23 @@ func (mp *MQTTPublisher) publishMetrics(exporter *EnvoyExporter) {
 		return
 	}
 
+	// A single gateway publishes directly under the topic prefix; several
+	// gateways each get a <prefix>/<gateway>/ subtree
+	for _, gateway := range exporter.gateways {
+		subtopic := ""
+		if len(exporter.gateways) > 1 {
+			subtopic = gateway.name + "/"
+		}
+		mp.publishGatewayMetrics(gateway, subtopic)
+	}
+
+	mp.lastPublish = time.Now().Unix()
+}
+
+// Publish the current metrics of one gateway
+func (mp *MQTTPublisher) publishGatewayMetrics(gateway *Gateway, prefix string) {
 	// Get current monitor data
-	exporter.monitorMutex.RLock()
-	monitorData := exporter.lastMonitorData
-	exporter.monitorMutex.RUnlock()
+	monitorData := gateway.currentSnapshot().Monitor
 
 	// Create metrics payload
 	metrics := MQTTMetrics{
@@ -177,20 +192,29 @@ func (mp *MQTTPublisher) publishMetrics(exporter *EnvoyExporter) {
 		SolarCoverage:    monitorData.Summary.SolarCoverage,
 	}
 
+	// The values pass the <mqtt><relabel> rules as series named after their
+	// topic, so rules can drop or rename them
+	values := mp.relabel.apply(mqttSeries(gateway, metrics))
+
 	// Publish as JSON payload to main topic
-	mp.publishJSON("metrics", metrics)
+	payload := map[string]interface{}{"timestamp": metrics.Timestamp}
+	for _, value := range values {
+		if value.Type == mqttCountSeries {
+			payload[value.Name] = int(value.Value)
+		} else {
+			payload[value.Name] = value.Value
+		}
+	}
+	mp.publishJSON(prefix+"metrics", payload)
 
 	// Publish individual metrics for easier consumption
-	mp.publishFloat("current_watts", metrics.CurrentWatts)
-	mp.publishFloat("today_wh", metrics.TodayWh)
-	mp.publishFloat("lifetime_wh", metrics.LifetimeWh)
-	mp.publishInt("inverters_online", metrics.InvertersOnline)
-	mp.publishInt("inverters_total", metrics.InvertersTotal)
-	mp.publishFloat("grid_watts", metrics.GridWatts)
-	mp.publishFloat("load_watts", metrics.LoadWatts)
-	mp.publishFloat("system_efficiency", metrics.SystemEfficiency)
-	mp.publishFloat("self_consumption", metrics.SelfConsumption)
-	mp.publishFloat("solar_coverage", metrics.SolarCoverage)
+	for _, value := range values {
+		if value.Type == mqttCountSeries {
+			mp.publishInt(prefix+value.Name, int(value.Value))
+		} else {
+			mp.publishFloat(prefix+value.Name, value.Value)
+		}
+	}
 
 	// Publish power flow direction
 	powerFlow := "idle"
@@ -199,7 +223,7 @@ func (mp *MQTTPublisher) publishMetrics(exporter *EnvoyExporter) {
 	} else if metrics.GridWatts < -10 {
 		powerFlow = "exporting"
 	}
-	mp.publishString("power_flow", powerFlow)
+	mp.publishString(prefix+"power_flow", powerFlow)
 
 	// Publish system status
 	systemStatus := "offline"
@@ -210,11 +234,33 @@ func (mp *MQTTPublisher) publishMetrics(exporter *EnvoyExporter) {
 	} else {
 		systemStatus = "night"
 	}
-	mp.publishString("system_status", systemStatus)
+	mp.publishString(prefix+"system_status", systemStatus)
 
-	mp.lastPublish = time.Now().Unix()
-	LogInfo("MQTT: Published metrics - Power: %.1fW, Inverters: %d/%d, Grid: %.1fW", 
-		metrics.CurrentWatts, metrics.InvertersOnline, metrics.InvertersTotal, metrics.GridWatts)
+	LogInfo("MQTT: Published %s metrics - Power: %.1fW, Inverters: %d/%d, Grid: %.1fW", 
+		gateway.name, metrics.CurrentWatts, metrics.InvertersOnline, metrics.InvertersTotal, metrics.GridWatts)
+}
+
+// mqttCountSeries marks values published as integers
+const mqttCountSeries = "count"
+
+// mqttSeries lists the published values as series carrying the gateway's
+// labels, in topic order
+func mqttSeries(gateway *Gateway, metrics MQTTMetrics) []metricSample {
+	set := &metricSet{}
+	add := func(topic string, kind string, value float64) {
+		set.add(topic, kind, "", gateway.labels(), value)
+	}
+	add("current_watts", "gauge", metrics.CurrentWatts)
+	add("today_wh", "gauge", metrics.TodayWh)
+	add("lifetime_wh", "gauge", metrics.LifetimeWh)
+	add("inverters_online", mqttCountSeries, float64(metrics.InvertersOnline))
+	add("inverters_total", mqttCountSeries, float64(metrics.InvertersTotal))
+	add("grid_watts", "gauge", metrics.GridWatts)
+	add("load_watts", "gauge", metrics.LoadWatts)
+	add("system_efficiency", "gauge", metrics.SystemEfficiency)
+	add("self_consumption", "gauge", metrics.SelfConsumption)
+	add("solar_coverage", "gauge", metrics.SolarCoverage)
+	return set.samples
 }
 
 // Helper functions for publishing different data types
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for the probe cache
+const (
+	defaultProbeMaxTargets  = 32
+	defaultProbeIdleTimeout = 10 * time.Minute
+)
+
+// errProbeTargetsFull is returned for a new target while the cache is full
+var errProbeTargetsFull = errors.New("too many probe targets")
+
+// probeTarget is a cached /probe gateway
+type probeTarget struct {
+	gateway  *Gateway
+	lastUsed time.Time
+}
+
+// AuthModule converts to the gateway overlay used for configured gateways
+func (m AuthModule) gatewayConfig(target string) GatewayConfig {
+	return GatewayConfig{
+		Name:           m.Name,
+		EnvoyIP:        target,
+		EnvoySerial:    m.EnvoySerial,
+		User:           m.User,
+		Password:       m.Password,
+		Token:          m.Token,
+		TokenFile:      m.TokenFile,
+		TokenEnv:       m.TokenEnv,
+		AuthMode:       m.AuthMode,
+		DigestUser:     m.DigestUser,
+		DigestPassword: m.DigestPassword,
+		GatewayTLS:     m.GatewayTLS,
+		Queries:        m.Queries,
+	}
+}
+
+// validateAuthModules rejects unnamed and duplicate auth modules and bad
+// target patterns
+func validateAuthModules(config Config) error {
+	if err := validateTargetPatterns(config.Probe.Targets); err != nil {
+		return fmt.Errorf("probe: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i, module := range config.AuthModules.Modules {
+		if module.Name == "" {
+			return fmt.Errorf("auth_module %d has no name", i+1)
+		}
+		if seen[module.Name] {
+			return fmt.Errorf("duplicate auth_module name %q", module.Name)
+		}
+		seen[module.Name] = true
+		if err := validateTargetPatterns(module.Targets); err != nil {
+			return fmt.Errorf("auth_module %s: %w", module.Name, err)
+		}
+		if module.Targets == "" && config.Probe.Targets == "" {
+			LogWarning("auth_module %s has no targets; /probe will refuse it until targets are listed", module.Name)
+		}
+	}
+	return nil
+}
+
+// targetPatterns splits a comma-separated list of host patterns
+func targetPatterns(list string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+func validateTargetPatterns(list string) error {
+	for _, pattern := range targetPatterns(list) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid target pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// targetAllowed matches a target, with or without its port, against shell
+// patterns such as 192.168.1.* or envoy-*.local:443
+func targetAllowed(list string, target string) bool {
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	for _, pattern := range targetPatterns(list) {
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *EnvoyExporter) findAuthModule(name string) (AuthModule, bool) {
+	for _, module := range e.config.AuthModules.Modules {
+		if module.Name == name {
+			return module, true
+		}
+	}
+	return AuthModule{}, false
+}
+
+// validProbeTarget accepts a host or host:port, nothing that could change
+// the request path or carry credentials. "|" is refused as well, as it
+// separates the target from the auth module in cache keys and state IDs.
+func validProbeTarget(target string) bool {
+	return target != "" && !strings.ContainsAny(target, "/?#@| \t\r\n")
+}
+
+// probeConfig builds a probed gateway's settings. The top-level credentials
+// belong to the configured gateway and are never sent to a probe target: they
+// come from the auth module, and without one the target is queried
+// unauthenticated.
+func (e *EnvoyExporter) probeConfig(target string, module AuthModule) Config {
+	base := e.config
+	base.User = ""
+	base.Password = ""
+	base.Token = ""
+	base.TokenFile = ""
+	base.TokenEnv = ""
+	base.EnvoySerial = ""
+	base.DigestUser = ""
+	base.DigestPassword = ""
+	if module.Name == "" {
+		base.AuthMode = authModeNone
+	}
+	return applyGatewayConfig(base, module.gatewayConfig(target))
+}
+
+// probeModule checks that a target may be probed with the named module.
+// Requests without a module are refused unless probe/allow_unauthenticated
+// is set.
+func (e *EnvoyExporter) probeModule(target string, moduleName string) (AuthModule, error) {
+	if moduleName == "" {
+		if !e.config.Probe.AllowUnauthenticated {
+			return AuthModule{}, fmt.Errorf("auth_module parameter is missing")
+		}
+		if e.config.Probe.Targets != "" && !targetAllowed(e.config.Probe.Targets, target) {
+			return AuthModule{}, fmt.Errorf("target %s is not allowed", target)
+		}
+		return AuthModule{}, nil
+	}
+
+	module, ok := e.findAuthModule(moduleName)
+	if !ok {
+		return AuthModule{}, fmt.Errorf("unknown auth_module %q", moduleName)
+	}
+	targets := module.Targets
+	if targets == "" {
+		targets = e.config.Probe.Targets
+	}
+	if !targetAllowed(targets, target) {
+		return AuthModule{}, fmt.Errorf("target %s is not allowed for auth_module %q", target, moduleName)
+	}
+	return module, nil
+}
+
+// probeGateway returns the cached gateway for a target, creating it on first
+// use. Token state and the certificate pin are kept per target and module.
+func (e *EnvoyExporter) probeGateway(target string, moduleName string) (*Gateway, error) {
+	module, err := e.probeModule(target, moduleName)
+	if err != nil {
+		return nil, err
+	}
+
+	key := moduleName + "|" + target
+	now := time.Now()
+
+	e.probeMutex.Lock()
+	defer e.probeMutex.Unlock()
+
+	e.evictIdleProbes(now)
+	if cached, ok := e.probeGateways[key]; ok {
+		cached.lastUsed = now
+		return cached.gateway, nil
+	}
+
+	maxTargets := e.config.Probe.MaxTargets
+	if maxTargets <= 0 {
+		maxTargets = defaultProbeMaxTargets
+	}
+	if len(e.probeGateways) >= maxTargets {
+		return nil, fmt.Errorf("%w (max_targets %d)", errProbeTargetsFull, maxTargets)
+	}
+
+	config := e.probeConfig(target, module)
+
+	g, err := newGateway(target, probeStateID(target, moduleName), config)
+	if err != nil {
+		return nil, err
+	}
+
+	// A failed login is retried with backoff by the next probe's request, so
+	// the gateway is cached either way
+	if err := g.startAuth(); err != nil {
+		LogWarning("Probe target %s: %v", target, err)
+	}
+
+	if e.probeGateways == nil {
+		e.probeGateways = make(map[string]*probeTarget)
+	}
+	e.probeGateways[key] = &probeTarget{gateway: g, lastUsed: now}
+	LogInfo("Probe target %s added (auth module %q)", target, moduleName)
+
+	return g, nil
+}
+
+// probeStateID names the state files of a probe target. The target and
+// module are hashed so that any two combinations get distinct, file-safe
+// names.
+func probeStateID(target, moduleName string) string {
+	sum := sha256.Sum256([]byte(target + "|" + moduleName))
+	return "probe_" + hex.EncodeToString(sum[:])
+}
+
+// Multi-target endpoint: /probe?target=<address>&auth_module=<name> runs the
+// query set against the target and returns its metrics
+func (e *EnvoyExporter) serveProbe(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if !validProbeTarget(target) {
+		http.Error(w, "target parameter is missing or invalid", http.StatusBadRequest)
+		return
+	}
+	moduleName := r.URL.Query().Get("auth_module")
+
+	g, err := e.probeGateway(target, moduleName)
+	if errors.Is(err, errProbeTargetsFull) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Stop before Prometheus gives up on the scrape; the request context is
+	// cancelled as well if it disconnects first
+	ctx := r.Context()
+	if timeout := scrapeTimeout(r); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	set := &metricSet{}
+	endpoints := g.fetchEndpoints(ctx, g.config.Queries)
+	for _, result := range endpoints {
+		g.recordQueryResults(result)
+	}
+	set.samples = append(set.samples, g.renderQueryMetrics(endpoints)...)
+	g.writeStatusMetrics(set)
+
+	success := 0.0
+	if len(endpoints) == 0 {
+		success = 1
+	}
+	for _, result := range endpoints {
+		if result.Err == nil {
+			success = 1
+			break
+		}
+	}
+
+	set.add("envoy_probe_success", "gauge", "Whether any query against the target returned data",
+		g.metricLabels(nil), success)
+	set.add("envoy_probe_duration_seconds", "gauge", "Time taken to query the target",
+		g.metricLabels(nil), time.Since(start).Seconds())
+
+	samplesHandler(func() []metricSample { return e.relabel.apply(set.samples) }).ServeHTTP(w, r)
+}
+
+// scrapeTimeout reads the scrape timeout Prometheus announces, keeping half a
+// second in hand to write the response
+func scrapeTimeout(r *http.Request) time.Duration {
+	seconds, err := strconv.ParseFloat(r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"), 64)
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	timeout := time.Duration(seconds*float64(time.Second)) - 500*time.Millisecond
+	if timeout < time.Second {
+		timeout = time.Second
+	}
+	return timeout
+}
+
+// evictIdleProbes drops targets not probed within idle_timeout, stopping
+// their token loops and removing their token state. The certificate pin is
+// kept, so a target probed again must still present the pinned certificate.
+// The caller holds probeMutex.
+func (e *EnvoyExporter) evictIdleProbes(now time.Time) {
+	idleTimeout := time.Duration(e.config.Probe.IdleTimeout) * time.Second
+	if idleTimeout <= 0 {
+		idleTimeout = defaultProbeIdleTimeout
+	}
+	for key, cached := range e.probeGateways {
+		if now.Sub(cached.lastUsed) < idleTimeout {
+			continue
+		}
+		g := cached.gateway
+		g.stop()
+		if err := os.Remove(g.tokenStateFile()); err != nil && !os.IsNotExist(err) {
+			LogWarning("Probe target %s: %v", g.name, err)
+		}
+		delete(e.probeGateways, key)
+		LogInfo("Probe target %s removed after %v idle", g.name, idleTimeout)
+	}
+}
+
+// probeTargets lists the targets seen by /probe with their auth module
+func (e *EnvoyExporter) probeTargets() map[string]string {
+	e.probeMutex.Lock()
+	defer e.probeMutex.Unlock()
+
+	targets := make(map[string]string, len(e.probeGateways))
+	for key, cached := range e.probeGateways {
+		targets[cached.gateway.name] = strings.SplitN(key, "|", 2)[0]
+	}
+	return targets
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestTargetAllowed(t *testing.T) {
+	tests := []struct {
+		patterns string
+		target   string
+		want     bool
+	}{
+		{"192.168.1.*", "192.168.1.20", true},
+		{"192.168.1.*", "192.168.1.20:443", true},
+		{"192.168.1.*", "192.168.2.20", false},
+		{"192.168.1.20:443", "192.168.1.20:8443", false},
+		{"envoy-*.local, 10.0.0.5", "10.0.0.5", true},
+		{"envoy-*.local, 10.0.0.5", "envoy-garage.local", true},
+		{"", "192.168.1.20", false},
+		{"*", "attacker.example:443", true},
+	}
+	for _, tt := range tests {
+		if got := targetAllowed(tt.patterns, tt.target); got != tt.want {
+			t.Errorf("targetAllowed(%q, %q) = %v, want %v", tt.patterns, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestProbeModule(t *testing.T) {
+	config := Config{
+		User:        "owner@example.com",
+		Password:    "secret",
+		Token:       "owner-token",
+		TokenFile:   "/etc/owner.token",
+		EnvoySerial: "122012345678",
+		AuthMode:    authModeJWT,
+		AuthModules: AuthModules{Modules: []AuthModule{
+			{Name: "site_b", Targets: "192.168.2.*", Token: "site-b-token"},
+			{Name: "any", Token: "any-token"},
+		}},
+	}
+
+	tests := []struct {
+		name            string
+		probe           ProbeConfig
+		target, module  string
+		errors          bool
+		token, authMode string
+	}{
+		{"module on listed target", ProbeConfig{}, "192.168.2.5", "site_b", false, "site-b-token", authModeJWT},
+		{"module on other target", ProbeConfig{}, "attacker:443", "site_b", true, "", ""},
+		{"module without targets", ProbeConfig{}, "192.168.2.5", "any", true, "", ""},
+		{"module with probe targets", ProbeConfig{Targets: "192.168.*"}, "192.168.7.1", "any", false, "any-token", authModeJWT},
+		{"unknown module", ProbeConfig{Targets: "*"}, "192.168.2.5", "nope", true, "", ""},
+		{"missing module", ProbeConfig{Targets: "*"}, "192.168.2.5", "", true, "", ""},
+		{"unauthenticated opt-in", ProbeConfig{AllowUnauthenticated: true}, "attacker:443", "", false, "", authModeNone},
+		{"unauthenticated outside targets", ProbeConfig{AllowUnauthenticated: true, Targets: "192.168.*"}, "attacker:443", "", true, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Probe = tt.probe
+			e := &EnvoyExporter{config: config}
+			module, err := e.probeModule(tt.target, tt.module)
+			if (err != nil) != tt.errors {
+				t.Fatalf("error = %v, want error %v", err, tt.errors)
+			}
+			if err != nil {
+				return
+			}
+
+			probed := e.probeConfig(tt.target, module)
+			if probed.User != "" || probed.Password != "" || probed.TokenFile != "" || probed.EnvoySerial != "" {
+				t.Errorf("probe inherited top-level credentials: %+v", probed)
+			}
+			if probed.Token != tt.token {
+				t.Errorf("token = %q, want %q", probed.Token, tt.token)
+			}
+			if probed.AuthMode != tt.authMode {
+				t.Errorf("auth_mode = %q, want %q", probed.AuthMode, tt.authMode)
+			}
+			if probed.EnvoyIP != tt.target {
+				t.Errorf("envoy_ip = %q, want %q", probed.EnvoyIP, tt.target)
+			}
+		})
+	}
+}
+
+func TestProbeGatewayCache(t *testing.T) {
+	e := &EnvoyExporter{config: Config{
+		WebDir:   t.TempDir(),
+		StateDir: t.TempDir(),
+		Probe:    ProbeConfig{AllowUnauthenticated: true, MaxTargets: 2, IdleTimeout: 60},
+	}}
+
+	first, err := e.probeGateway("10.0.0.1", "")
+	if err != nil {
+		t.Fatalf("probeGateway: %v", err)
+	}
+	if again, _ := e.probeGateway("10.0.0.1", ""); again != first {
+		t.Errorf("cached target was not reused")
+	}
+	if _, err := e.probeGateway("10.0.0.2", ""); err != nil {
+		t.Fatalf("probeGateway: %v", err)
+	}
+	if _, err := e.probeGateway("10.0.0.3", ""); !errors.Is(err, errProbeTargetsFull) {
+		t.Fatalf("third target: error = %v, want %v", err, errProbeTargetsFull)
+	}
+
+	// Once the first target has been idle too long it makes room, keeping
+	// its certificate pin
+	pinFile := first.certVerifier.pinFile
+	if err := os.WriteFile(pinFile, []byte("pinned"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	e.probeGateways["|10.0.0.1"].lastUsed = time.Now().Add(-2 * time.Minute)
+	if _, err := e.probeGateway("10.0.0.3", ""); err != nil {
+		t.Fatalf("probeGateway after eviction: %v", err)
+	}
+	if _, ok := e.probeGateways["|10.0.0.1"]; ok {
+		t.Errorf("idle target was not evicted")
+	}
+	select {
+	case <-first.stopped:
+	default:
+		t.Errorf("evicted gateway was not stopped")
+	}
+	if _, err := os.Stat(pinFile); err != nil {
+		t.Errorf("certificate pin removed on eviction: %v", err)
+	}
+}
+
+func TestProbeStateID(t *testing.T) {
+	probes := [][2]string{
+		{"envoy-a.local", ""},
+		{"envoy-a_local", ""},
+		{"envoy-a.local", "site_b"},
+		{"envoy-a.local_site_b", ""},
+		{"192.168.1.20:443", ""},
+		{"192.168.1.20_443", ""},
+	}
+	seen := make(map[string][2]string)
+	for _, probe := range probes {
+		id := probeStateID(probe[0], probe[1])
+		if other, ok := seen[id]; ok {
+			t.Errorf("%v and %v share state ID %s", probe, other, id)
+		}
+		seen[id] = probe
+		if !regexp.MustCompile(`^probe_[0-9a-f]{64}$`).MatchString(id) {
+			t.Errorf("state ID %q is not a safe file name", id)
+		}
+	}
+	if probeStateID("envoy-a.local", "site_b") != probeStateID("envoy-a.local", "site_b") {
+		t.Errorf("state ID is not stable")
+	}
+	if validProbeTarget("envoy-a.local|site_b") {
+		t.Errorf("target containing the key separator accepted")
+	}
+}
@@ -1,127 +1,31 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"math"
 	"net/http"
-	"net/url"
-	"reflect"
 	"sort"
 	"strings"
 	"time"
 )
 
-func (e *EnvoyExporter) refreshToken() error {
-	// Login to get session ID
-	loginData := url.Values{}
-	loginData.Set("user[email]", e.config.User)
-	loginData.Set("user[password]", e.config.Password)
-
-	resp, err := e.httpClient.PostForm("https://enlighten.enphaseenergy.com/login/login.json?", loginData)
-	if err != nil {
-		return fmt.Errorf("login request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	var loginResp LoginResponse
-	err = json.NewDecoder(resp.Body).Decode(&loginResp)
-	if err != nil {
-		return fmt.Errorf("failed to decode login response: %w", err)
-	}
-
-	if loginResp.Message != "success" {
-		return fmt.Errorf("login failed: %s", loginResp.Message)
-	}
-
-	// Get web token
-	tokenReq := map[string]interface{}{
-		"session_id": loginResp.SessionID,
-		"serial_num": e.config.EnvoySerial,
-		"username":   e.config.User,
-	}
-
-	tokenData, err := json.Marshal(tokenReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal token request: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", "https://entrez.enphaseenergy.com/tokens", strings.NewReader(string(tokenData)))
-	if err != nil {
-		return fmt.Errorf("failed to create token request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err = e.httpClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("token request failed: %w", err)
-	}
-	defer resp.Body.Close()
-
-	tokenBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("failed to read token response: %w", err)
-	}
-
-	// Parse as TokenResponse if it's JSON, otherwise use as raw token
-	var tokenResp TokenResponse
-	if err := json.Unmarshal(tokenBody, &tokenResp); err == nil && tokenResp.Token != "" {
-		e.tokenMutex.Lock()
-		e.token = tokenResp.Token
-		e.tokenExpires = tokenResp.ExpiresAt
-		e.tokenMutex.Unlock()
-	} else {
-		// Raw token string
-		e.tokenMutex.Lock()
-		e.token = strings.TrimSpace(string(tokenBody))
-		e.tokenExpires = time.Now().Add(24 * time.Hour).Unix() // Default 24h expiry
-		e.tokenMutex.Unlock()
-	}
-
-	LogInfo("Token refreshed, expires at: %s", time.Unix(e.tokenExpires, 0))
-	return nil
-}
-
-func (e *EnvoyExporter) tokenRefreshLoop() {
-	for {
-		e.tokenMutex.RLock()
-		expiresAt := e.tokenExpires
-		e.tokenMutex.RUnlock()
-
-		// Refresh 1 hour before expiry
-		refreshTime := time.Unix(expiresAt, 0).Add(-1 * time.Hour)
-		sleepDuration := time.Until(refreshTime)
-
-		if sleepDuration <= 0 {
-			sleepDuration = 5 * time.Minute // Retry in 5 minutes if already expired
-		}
-
-		time.Sleep(sleepDuration)
-
-		err := e.refreshToken()
-		if err != nil {
-			LogInfo("Failed to refresh token: %v", err)
-			time.Sleep(5 * time.Minute) // Retry in 5 minutes
-		}
-	}
-}
-
-func (e *EnvoyExporter) monitorDataRefreshLoop() {
-	for {
-		e.refreshMonitorData()
-		time.Sleep(30 * time.Second) // Update every 30 seconds
-	}
-}
+// Inverter counts of the dashboard summary
+var (
+	inverterTotalMetric  = Metric{Name: "inverters_total", Aggregate: "count"}
+	inverterActiveMetric = Metric{Name: "inverters_active", Aggregate: "count", Filter: "@.lastReportWatts > 0"}
+)
 
-func (e *EnvoyExporter) refreshMonitorData() {
+// buildMonitorData derives the dashboard view from the polled endpoints
+func (g *Gateway) buildMonitorData(endpoints map[string]*EndpointResult) MonitorData {
 	var monitorData MonitorData
 	monitorData.Timestamp = time.Now()
 
 	// Get production data
-	if data, err := e.makeEnvoyRequest("https://{envoy_ip}/api/v1/production"); err == nil {
-		var prodData map[string]interface{}
-		if json.Unmarshal(data, &prodData) == nil {
+	if result := endpoints[monitorProductionURL]; result != nil && result.Data != nil {
+		if prodData, ok := result.Data.(map[string]interface{}); ok {
 			if watts, ok := prodData["wattsNow"].(float64); ok {
 				monitorData.Production.CurrentWatts = watts
 			}
@@ -138,21 +42,20 @@ func (e *EnvoyExporter) refreshMonitorData() {
 	}
 
 	// Get inverter data
-	if data, err := e.makeEnvoyRequest("https://{envoy_ip}/api/v1/production/inverters"); err == nil {
-		var invData []map[string]interface{}
-		if json.Unmarshal(data, &invData) == nil {
+	if result := endpoints[monitorInvertersURL]; result != nil && result.Data != nil {
+		if invData, ok := result.Data.([]interface{}); ok {
 			monitorData.Inverters = make([]InverterData, 0, len(invData))
-			activeCount := 0
-			for _, inv := range invData {
+			for _, item := range invData {
+				inv, ok := item.(map[string]interface{})
+				if !ok {
+					continue
+				}
 				inverter := InverterData{}
 				if serial, ok := inv["serialNumber"].(string); ok {
 					inverter.Serial = serial
 				}
 				if watts, ok := inv["lastReportWatts"].(float64); ok {
 					inverter.CurrentWatts = watts
-					if watts > 0 {
-						activeCount++
-					}
 				}
 				if maxWatts, ok := inv["maxReportWatts"].(float64); ok {
 					inverter.MaxWatts = maxWatts
@@ -165,8 +68,9 @@ func (e *EnvoyExporter) refreshMonitorData() {
 				}
 				monitorData.Inverters = append(monitorData.Inverters, inverter)
 			}
-			monitorData.Summary.TotalInverters = len(invData)
-			monitorData.Summary.ActiveInverters = activeCount
+			items := children(jsonPathMatch{Value: invData})
+			monitorData.Summary.TotalInverters = int(g.aggregateItems(inverterTotalMetric, items))
+			monitorData.Summary.ActiveInverters = int(g.aggregateItems(inverterActiveMetric, items))
 		}
 	}
 
@@ -176,9 +80,8 @@ func (e *EnvoyExporter) refreshMonitorData() {
 	})
 
 	// Get power flow data from livedata
-	if data, err := e.makeEnvoyRequest("https://{envoy_ip}/ivp/livedata/status"); err == nil {
-		var liveData map[string]interface{}
-		if json.Unmarshal(data, &liveData) == nil {
+	if result := endpoints[monitorLivedataURL]; result != nil && result.Data != nil {
+		if liveData, ok := result.Data.(map[string]interface{}); ok {
 			if meters, ok := liveData["meters"].(map[string]interface{}); ok {
 				// PV power
 				if pv, ok := meters["pv"].(map[string]interface{}); ok {
@@ -218,7 +121,7 @@ func (e *EnvoyExporter) refreshMonitorData() {
 	}
 
 	// Calculate solar position
-	monitorData.SolarPosition = e.calculateSolarPosition()
+	monitorData.SolarPosition = g.calculateSolarPosition()
 
 	// Calculate summary metrics
 	if monitorData.PowerFlow.PVWatts > 0 && monitorData.PowerFlow.LoadWatts > 0 {
@@ -232,16 +135,13 @@ func (e *EnvoyExporter) refreshMonitorData() {
 		monitorData.Summary.SystemEfficiency = float64(monitorData.Summary.ActiveInverters) / float64(monitorData.Summary.TotalInverters) * 100
 	}
 
-	// Store the data
-	e.monitorMutex.Lock()
-	e.lastMonitorData = monitorData
-	e.monitorMutex.Unlock()
+	return monitorData
 }
 
-func (e *EnvoyExporter) calculateSolarPosition() SolarPosition {
+func (g *Gateway) calculateSolarPosition() SolarPosition {
 	now := time.Now()
-	lat := e.config.Latitude
-	//lng := e.config.Longitude
+	lat := g.config.Latitude
+	//lng := g.config.Longitude
 
 	// Convert to radians
 	latRad := lat * math.Pi / 180.0
@@ -288,62 +188,117 @@ func (e *EnvoyExporter) calculateSolarPosition() SolarPosition {
 	}
 }
 
-func (e *EnvoyExporter) getToken() string {
-	e.tokenMutex.RLock()
-	defer e.tokenMutex.RUnlock()
-	return e.token
+// makeEnvoyRequest fetches an endpoint returning a body in the given format,
+// giving up when ctx is done. It also returns the HTTP status of the final
+// response (0 if none was received).
+func (g *Gateway) makeEnvoyRequest(ctx context.Context, endpoint string, format responseFormat) ([]byte, int, error) {
+	// Digest credentials are added by the transport; no token is involved
+	if g.config.AuthMode != authModeJWT {
+		return g.doEnvoyRequest(ctx, endpoint, format, "")
+	}
+
+	token := g.getToken()
+	body, status, err := g.authorizedRequest(ctx, endpoint, format, token)
+	if err == nil {
+		g.tokenAccepted(token)
+	}
+	if !isUnauthorized(err) || ctx.Err() != nil {
+		return body, status, err
+	}
+
+	// The gateway rejected the token: refresh it once (shared with any
+	// concurrent callers) and retry the request transparently
+	if refreshErr := g.reauthenticate(ctx, token); refreshErr != nil {
+		return nil, status, fmt.Errorf("%w (re-authentication failed: %v)", err, refreshErr)
+	}
+
+	return g.authorizedRequest(ctx, endpoint, format, g.getToken())
 }
 
-func (e *EnvoyExporter) makeEnvoyRequest(endpoint string) ([]byte, error) {
-	url := strings.ReplaceAll(endpoint, "{envoy_ip}", e.config.EnvoyIP)
+// authorizedRequest sends the request with the session cookie when a session
+// is established, falling back to the bearer header if it is rejected
+func (g *Gateway) authorizedRequest(ctx context.Context, endpoint string, format responseFormat, token string) ([]byte, int, error) {
+	if g.ensureSession(ctx, token) {
+		body, status, err := g.doEnvoyRequest(ctx, endpoint, format, "")
+		if !isUnauthorized(err) {
+			return body, status, err
+		}
+		LogWarning("Envoy session rejected, falling back to bearer token")
+		g.dropSession(err)
+	}
+
+	return g.doEnvoyRequest(ctx, endpoint, format, token)
+}
+
+func (g *Gateway) doEnvoyRequest(ctx context.Context, endpoint string, format responseFormat, token string) ([]byte, int, error) {
+	envoyIP := g.envoyIP()
+	if envoyIP == "" {
+		return nil, 0, fmt.Errorf("gateway address not discovered yet")
+	}
+	url := strings.ReplaceAll(endpoint, "{envoy_ip}", envoyIP)
 	
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, 0, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Accept", "application/json")
-	token := e.getToken()
+	req.Header.Set("Accept", format.accept())
 	if token != "" {
 		req.Header.Set("Authorization", "Bearer "+token)
 	}
 
-	resp, err := e.httpClient.Do(req)
+	resp, err := g.gatewayClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return nil, 0, fmt.Errorf("request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return nil, resp.StatusCode, fmt.Errorf("failed to read response body: %w", err)
 	}
 
-	// Check for HTML response (usually indicates auth or endpoint issues)
-	if strings.HasPrefix(strings.TrimSpace(string(body)), "<") {
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, resp.StatusCode, fmt.Errorf("%w - token may be expired or invalid", errEnvoyUnauthorized)
+	}
+
+	if isLoginPage(body) {
+		return nil, resp.StatusCode, fmt.Errorf("%w - gateway redirected to its login page", errEnvoyUnauthorized)
+	}
+
+	// An HTML body where JSON was expected usually indicates endpoint issues.
+	// XML and text bodies may legitimately start with a tag.
+	if format.kind == formatJSON && strings.HasPrefix(strings.TrimSpace(string(body)), "<") {
 		// Try to extract useful info from HTML error
-		if strings.Contains(string(body), "401") || strings.Contains(string(body), "Unauthorized") {
-			return nil, fmt.Errorf("authentication failed (401) - token may be expired or invalid")
-		}
 		if strings.Contains(string(body), "404") || strings.Contains(string(body), "Not Found") {
-			return nil, fmt.Errorf("endpoint not found (404) - feature may not be available on this Envoy model")
+			return nil, resp.StatusCode, fmt.Errorf("endpoint not found (404) - feature may not be available on this Envoy model")
 		}
 		if strings.Contains(string(body), "403") || strings.Contains(string(body), "Forbidden") {
-			return nil, fmt.Errorf("access forbidden (403) - endpoint may require installer/owner privileges")
+			return nil, resp.StatusCode, fmt.Errorf("access forbidden (403) - endpoint may require installer/owner privileges")
 		}
-		return nil, fmt.Errorf("received HTML response instead of JSON (status: %d) - endpoint may not be available", resp.StatusCode)
+		return nil, resp.StatusCode, fmt.Errorf("received HTML response instead of JSON (status: %d) - endpoint may not be available", resp.StatusCode)
+	}
+
+	if resp.StatusCode >= 400 {
+		return nil, resp.StatusCode, fmt.Errorf("gateway returned HTTP %d", resp.StatusCode)
 	}
 
 	// Check for empty response
 	if len(body) == 0 {
-		return nil, fmt.Errorf("received empty response")
+		return nil, resp.StatusCode, fmt.Errorf("received empty response")
 	}
 
-	return body, nil
+	return body, resp.StatusCode, nil
+}
+
+// isLoginPage reports whether an HTML body is the gateway's login form
+func isLoginPage(body []byte) bool {
+	lower := strings.ToLower(string(body))
+	return strings.Contains(lower, "<form") && strings.Contains(lower, "login")
 }
 
 // Include all the existing metric processing methods here...
-// (checkCondition, evaluateConditionCheck, jsonPathExists, etc.)
+// (getJSONPathValue, etc.)
 // I'll continue with the web serving methods
 
 func (e *EnvoyExporter) serveStaticFiles() http.Handler {
@@ -354,157 +309,27 @@ func (e *EnvoyExporter) serveMonitorAPI(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	
-	e.monitorMutex.RLock()
-	data := e.lastMonitorData
-	e.monitorMutex.RUnlock()
-	
-	json.NewEncoder(w).Encode(data)
-}
-
-// Add all the missing methods that were referenced but not included
-func (e *EnvoyExporter) checkCondition(condition string, data interface{}) bool {
-	if condition == "" {
-		return true
-	}
-	
-	// Find condition definition
-	for _, cond := range e.config.Conditions.Conditions {
-		if cond.Name == condition {
-			return e.evaluateConditionCheck(cond.Check, data)
-		}
-	}
-	
-	// Default to true if condition not found
-	return true
-}
-
-func (e *EnvoyExporter) evaluateConditionCheck(check string, data interface{}) bool {
-	switch {
-	case check == "endpoint_accessible":
-		return data != nil
-	case strings.HasPrefix(check, "json_path_exists"):
-		path := strings.Trim(strings.TrimPrefix(check, "json_path_exists("), "()\"")
-		return e.jsonPathExists(data, path)
-	case strings.HasPrefix(check, "json_path_value"):
-		// Extract path and comparison
-		parts := strings.Split(check, " ")
-		if len(parts) >= 3 {
-			path := strings.Trim(strings.TrimPrefix(parts[0], "json_path_value("), "()\"")
-			value := e.getJSONPathValue(data, path)
-			if floatVal, ok := value.(float64); ok {
-				return floatVal != 0
-			}
-		}
-		return false
-	case strings.Contains(check, "array_has_type"):
-		typeVal := strings.Trim(strings.TrimPrefix(check, "array_has_type("), "()\"")
-		return e.arrayHasType(data, typeVal)
-	default:
-		return true
+	g, ok := e.requestGateway(w, r)
+	if !ok {
+		return
 	}
-}
 
-func (e *EnvoyExporter) jsonPathExists(data interface{}, path string) bool {
-	return e.getJSONPathValue(data, path) != nil
-}
-
-func (e *EnvoyExporter) getJSONPathValue(data interface{}, path string) interface{} {
-	if data == nil {
-		return nil
-	}
-	
-	parts := strings.Split(path, ".")
-	current := data
+	data := g.currentSnapshot().Monitor
 	
-	for _, part := range parts {
-		if current == nil {
-			return nil
-		}
-		
-		switch v := current.(type) {
-		case map[string]interface{}:
-			current = v[part]
-		case []interface{}:
-			return nil
-		default:
-			val := reflect.ValueOf(current)
-			if val.Kind() == reflect.Ptr {
-				val = val.Elem()
-			}
-			if val.Kind() == reflect.Struct {
-				field := val.FieldByName(strings.Title(part))
-				if field.IsValid() {
-					current = field.Interface()
-				} else {
-					return nil
-				}
-			} else {
-				return nil
-			}
-		}
-	}
-	
-	return current
+	json.NewEncoder(w).Encode(data)
 }
 
-func (e *EnvoyExporter) arrayHasType(data interface{}, typeVal string) bool {
-	if arr, ok := data.([]interface{}); ok {
-		for _, item := range arr {
-			if itemMap, ok := item.(map[string]interface{}); ok {
-				if t, ok := itemMap["type"].(string); ok && t == typeVal {
-					return true
-				}
-			}
-		}
+// getJSONPathValue returns the first node the path selects, or nil
+func (g *Gateway) getJSONPathValue(data interface{}, path string) interface{} {
+	matches, err := evaluateJSONPath(data, path)
+	if err != nil {
+		LogDebug("Gateway %s: %v", g.name, err)
+		return nil
 	}
-	return false
-}
-
-func (e *EnvoyExporter) transformValue(value interface{}, transform string) interface{} {
-	switch transform {
-	case "bool_to_int":
-		if b, ok := value.(bool); ok {
-			if b {
-				return 1
-			}
-			return 0
-		}
-	case "mw_to_watts":
-		if f, ok := value.(float64); ok {
-			return f / 1000.0
-		}
-		if i, ok := value.(int); ok {
-			return float64(i) / 1000.0
-		}
-	case "connected_to_int":
-		if s, ok := value.(string); ok && s == "connected" {
-			return 1
-		}
-		return 0
-	case "ok_to_int":
-		if s, ok := value.(string); ok && s == "ok" {
-			return 1
-		}
-		return 0
-	case "enabled_to_int":
-		if s, ok := value.(string); ok && s == "enabled" {
-			return 1
-		}
-		return 0
-	case "battery_state_to_int":
-		if s, ok := value.(string); ok {
-			switch s {
-			case "charging":
-				return 1
-			case "discharging":
-				return -1
-			default:
-				return 0
-			}
-		}
-		return 0
+	if len(matches) == 0 {
+		return nil
 	}
-	return value
+	return matches[0].Value
 }
 
 func (e *EnvoyExporter) serveHealth(w http.ResponseWriter, r *http.Request) {
@@ -513,23 +338,9 @@ func (e *EnvoyExporter) serveHealth(w http.ResponseWriter, r *http.Request) {
 	// Basic system health
 	status := map[string]interface{}{
 		"status":    "ok",
-		"envoy_ip":  e.config.EnvoyIP,
 		"timestamp": time.Now().Unix(),
 	}
 
-	// Add production tracker status
-	if e.productionTracker != nil {
-		status["production_tracking"] = map[string]interface{}{
-			"enabled": true,
-			"days_stored": len(e.productionTracker.history.Days),
-			"last_cleanup": e.productionTracker.history.LastCleanup,
-		}
-	} else {
-		status["production_tracking"] = map[string]interface{}{
-			"enabled": false,
-		}
-	}
-
 	// Add MQTT status
 	mqttStatus := map[string]interface{}{
 		"enabled": e.config.MQTT.Enabled,
@@ -556,10 +367,57 @@ func (e *EnvoyExporter) serveHealth(w http.ResponseWriter, r *http.Request) {
 	
 	status["mqtt"] = mqttStatus
 
+	gateways := make(map[string]interface{}, len(e.gateways))
+	for _, g := range e.gateways {
+		gateways[g.name] = g.healthStatus()
+	}
+	status["gateways"] = gateways
+
+	// The primary gateway is also reported at the top level for existing
+	// dashboards and health checks
+	if primary := e.primaryGateway(); primary != nil {
+		for key, value := range primary.healthStatus() {
+			status[key] = value
+		}
+	}
+
+	if len(e.config.AuthModules.Modules) > 0 {
+		status["probe_targets"] = e.probeTargets()
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// healthStatus reports connectivity, authentication and data freshness for
+// one gateway
+func (g *Gateway) healthStatus() map[string]interface{} {
+	status := map[string]interface{}{
+		"envoy_ip": g.envoyIP(),
+		"serial":   g.config.EnvoySerial,
+		"address":  g.addressStatus(),
+	}
+
+	// Endpoints that stopped answering, e.g. after a firmware update
+	status["queries"] = g.queryHealth()
+
+	// Add production tracker status
+	if g.productionTracker != nil {
+		status["production_tracking"] = map[string]interface{}{
+			"enabled": true,
+			"days_stored": len(g.productionTracker.history.Days),
+			"last_cleanup": g.productionTracker.history.LastCleanup,
+		}
+	} else {
+		status["production_tracking"] = map[string]interface{}{
+			"enabled": false,
+		}
+	}
+
+	// Gateway certificate verification
+	status["gateway_tls"] = g.certVerifier.status()
+
 	// Add monitor data freshness
-	e.monitorMutex.RLock()
-	lastMonitorUpdate := e.lastMonitorData.Timestamp
-	e.monitorMutex.RUnlock()
+	lastMonitorUpdate := g.currentSnapshot().Monitor.Timestamp
 	
 	if !lastMonitorUpdate.IsZero() {
 		status["monitor_data"] = map[string]interface{}{
@@ -575,35 +433,57 @@ func (e *EnvoyExporter) serveHealth(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Token status
-	e.tokenMutex.RLock()
-	tokenExpires := e.tokenExpires
-	hasToken := e.token != ""
-	e.tokenMutex.RUnlock()
+	g.tokenMutex.RLock()
+	tokenExpires := g.tokenExpires
+	tokenSource := g.tokenSource
+	tokenScope := g.tokenScope
+	tokenIssued := g.tokenIssued
+	hasToken := g.token != ""
+	g.tokenMutex.RUnlock()
 	
 	status["authentication"] = map[string]interface{}{
+		"mode": g.config.AuthMode,
 		"has_token": hasToken,
+		"token_source": tokenSource,
+		"token_scope": tokenScope,
+		"token_issued": tokenIssued,
 		"token_expires": tokenExpires,
-		"token_valid": hasToken && tokenExpires > time.Now().Unix(),
+		"token_valid": hasToken && (tokenExpires == 0 || tokenExpires > time.Now().Unix()),
+		"refresh": g.refreshStatus(),
+		"session": g.sessionStatus(),
 	}
 
-	json.NewEncoder(w).Encode(status)
+	return status
 }
 
 func (e *EnvoyExporter) serveDebug(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	debug := map[string]interface{}{
 		"config": map[string]interface{}{
-			"envoy_ip": e.config.EnvoyIP,
+			"envoy_ip": e.primaryEnvoyIP(),
 			"web_dir": e.config.WebDir,
+			"state_dir": e.config.StateDir,
+			"gateways": e.gatewayNames(),
 		},
+		// Full configuration with passwords, tokens and proxy credentials masked
+		"settings": redactConfig(e.config),
+	}
+
+	// Last execution of every query, per gateway
+	queryResults := make(map[string]interface{}, len(e.gateways))
+	for _, g := range e.gateways {
+		queryResults[g.name] = g.sortedQueryResults()
 	}
+	debug["query_results"] = queryResults
 	json.NewEncoder(w).Encode(debug)
 }
 
 func (e *EnvoyExporter) getTotalMetricCount() int {
 	total := 0
-	for _, query := range e.config.Queries {
-		total += len(query.Metrics)
+	for _, g := range e.gateways {
+		for _, query := range g.config.Queries {
+			total += len(query.Metrics)
+		}
 	}
 	return total
 }
@@ -0,0 +1,138 @@
+// envoy_query_results.go - Per-query execution results and health metrics
+package main
+
+import (
+	"sort"
+)
+
+// recordQueryResults stores the outcome of an endpoint poll for every query
+// that uses the endpoint
+func (g *Gateway) recordQueryResults(result *EndpointResult) {
+	g.resultsMutex.Lock()
+	defer g.resultsMutex.Unlock()
+
+	for _, query := range g.config.Queries {
+		if query.URL != result.URL {
+			continue
+		}
+
+		queryResult := QueryResult{
+			Name:        query.Name,
+			URL:         query.URL,
+			Success:     result.Err == nil,
+			DataSize:    result.Size,
+			IsJSON:      result.IsJSON,
+			HasData:     hasData(result.Data),
+			StatusCode:  result.StatusCode,
+			Duration:    result.Duration.Seconds(),
+			Timestamp:   result.FetchedAt.Unix(),
+			LastSuccess: g.queryResults[query.Name].LastSuccess,
+		}
+		if result.Err != nil {
+			queryResult.Error = result.Err.Error()
+		} else {
+			queryResult.LastSuccess = queryResult.Timestamp
+		}
+
+		g.queryResults[query.Name] = queryResult
+	}
+}
+
+// hasData reports whether a parsed response holds anything
+func hasData(data interface{}) bool {
+	switch v := data.(type) {
+	case nil:
+		return false
+	case map[string]interface{}:
+		return len(v) > 0
+	case []interface{}:
+		return len(v) > 0
+	default:
+		return true
+	}
+}
+
+// sortedQueryResults returns the recorded results ordered by query name
+func (g *Gateway) sortedQueryResults() []QueryResult {
+	g.resultsMutex.RLock()
+	defer g.resultsMutex.RUnlock()
+
+	results := make([]QueryResult, 0, len(g.queryResults))
+	for _, result := range g.queryResults {
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+	return results
+}
+
+// writeQueryMetrics exports the scrape health of every executed query
+func (g *Gateway) writeQueryMetrics(set *metricSet) {
+	results := g.sortedQueryResults()
+	if len(results) == 0 {
+		return
+	}
+
+	families := []struct {
+		name  string
+		kind  string
+		help  string
+		value func(QueryResult) float64
+	}{
+		{"envoy_query_up", "gauge", "Whether the last execution of the query succeeded", func(r QueryResult) float64 {
+			if r.Success {
+				return 1
+			}
+			return 0
+		}},
+		{"envoy_query_duration_seconds", "gauge", "Duration of the last execution of the query", func(r QueryResult) float64 {
+			return r.Duration
+		}},
+		{"envoy_query_http_status", "gauge", "HTTP status of the last response to the query (0 if none)", func(r QueryResult) float64 {
+			return float64(r.StatusCode)
+		}},
+		{"envoy_query_response_bytes", "gauge", "Size of the last response to the query", func(r QueryResult) float64 {
+			return float64(r.DataSize)
+		}},
+		{"envoy_query_last_success_timestamp", "gauge", "Time of the last successful execution of the query (0 if never)", func(r QueryResult) float64 {
+			return float64(r.LastSuccess)
+		}},
+	}
+
+	for _, family := range families {
+		for _, result := range results {
+			set.add(family.name, family.kind, family.help,
+				g.metricLabels(map[string]string{"query": result.Name}), family.value(result))
+		}
+	}
+}
+
+// queryHealth summarizes the query results for /health
+func (g *Gateway) queryHealth() map[string]interface{} {
+	results := g.sortedQueryResults()
+
+	queries := make(map[string]interface{}, len(results))
+	failing := make([]string, 0)
+	for _, result := range results {
+		status := map[string]interface{}{
+			"up":           result.Success,
+			"status_code":  result.StatusCode,
+			"last_success": result.LastSuccess,
+		}
+		if result.Error != "" {
+			status["error"] = result.Error
+		}
+		queries[result.Name] = status
+
+		if !result.Success {
+			failing = append(failing, result.Name)
+		}
+	}
+
+	return map[string]interface{}{
+		"total":   len(results),
+		"failing": failing,
+		"results": queries,
+	}
+}
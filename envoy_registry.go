@@ -0,0 +1,148 @@
+// envoy_registry.go - Metric samples and their exposition via client_golang
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricSample is one exposed series. Samples are plain values so they can
+// be kept in snapshots and rewritten before exposition.
+type metricSample struct {
+	Name   string
+	Help   string
+	Type   string // gauge, counter or anything else for untyped
+	Labels map[string]string
+	Value  float64
+}
+
+// metricSet collects the samples of one collection pass
+type metricSet struct {
+	samples []metricSample
+}
+
+func (s *metricSet) add(name string, kind string, help string, labels map[string]string, value float64) {
+	s.samples = append(s.samples, metricSample{
+		Name:   name,
+		Help:   help,
+		Type:   kind,
+		Labels: labels,
+		Value:  value,
+	})
+}
+
+// sampleValue converts a value taken from a JSON response or the config to
+// a float. Non-numeric strings are rejected.
+func sampleValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// sampleCollector exposes samples produced by a function on every scrape.
+// It is an unchecked collector: the metric names come from the config.
+type sampleCollector struct {
+	collect func() []metricSample
+}
+
+func (c sampleCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c sampleCollector) Collect(ch chan<- prometheus.Metric) {
+	emitSamples(c.collect(), ch)
+}
+
+// emitSamples converts samples to constant metrics. A family keeps the HELP
+// and TYPE of its first sample so every series of a name is consistent; the
+// registry then reports duplicate series and invalid names.
+func emitSamples(samples []metricSample, ch chan<- prometheus.Metric) {
+	families := make(map[string]metricSample)
+	descs := make(map[string]*prometheus.Desc)
+
+	for _, sample := range samples {
+		family, ok := families[sample.Name]
+		if !ok {
+			family = sample
+			if family.Help == "" {
+				family.Help = sample.Name
+			}
+			families[sample.Name] = family
+		}
+
+		names := make([]string, 0, len(sample.Labels))
+		for name := range sample.Labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		values := make([]string, len(names))
+		for i, name := range names {
+			values[i] = sample.Labels[name]
+		}
+
+		key := sample.Name + "\xff" + strings.Join(names, "\xff")
+		desc, ok := descs[key]
+		if !ok {
+			desc = prometheus.NewDesc(sample.Name, family.Help, names, nil)
+			descs[key] = desc
+		}
+
+		metric, err := prometheus.NewConstMetric(desc, sampleValueType(family.Type), sample.Value, values...)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(desc, err)
+			continue
+		}
+		ch <- metric
+	}
+}
+
+func sampleValueType(kind string) prometheus.ValueType {
+	switch kind {
+	case "counter":
+		return prometheus.CounterValue
+	case "gauge":
+		return prometheus.GaugeValue
+	default:
+		return prometheus.UntypedValue
+	}
+}
+
+// registryLogger reports collection problems such as duplicate series
+type registryLogger struct{}
+
+func (registryLogger) Println(v ...interface{}) {
+	LogWarning("Metrics: %s", strings.TrimSpace(fmt.Sprintln(v...)))
+}
+
+// samplesHandler serves samples in the text format or OpenMetrics, as
+// negotiated, gzip-compressed when the client accepts it. Series that fail
+// validation are dropped and logged; the rest are still served.
+func samplesHandler(collect func() []metricSample) http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(sampleCollector{collect: collect})
+
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorLog:          registryLogger{},
+		ErrorHandling:     promhttp.ContinueOnError,
+		EnableOpenMetrics: true,
+	})
+}
@@ -0,0 +1,187 @@
+// envoy_relabel.go - Prometheus-style relabeling of exposed series
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Relabel rules rewrite or drop series as they are exposed, after calculated
+// metrics were computed from the original names. They follow Prometheus'
+// metric_relabel_configs: the metric name is the __name__ label, regexes
+// are anchored and a series whose __name__ ends up empty is dropped.
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelMap  = "labelmap"
+	relabelLabelDrop = "labeldrop"
+	relabelLabelKeep = "labelkeep"
+	relabelHashMod   = "hashmod"
+)
+
+type relabelRule struct {
+	action       string
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	modulus      uint64
+}
+
+// relabelRules are applied in order to every series
+type relabelRules []relabelRule
+
+// compileRelabelRules checks the rules and fills in Prometheus' defaults
+func compileRelabelRules(config RelabelConfigs) (relabelRules, error) {
+	rules := make(relabelRules, 0, len(config.Rules))
+	for i, rule := range config.Rules {
+		compiled := relabelRule{
+			action:      strings.ToLower(strings.TrimSpace(rule.Action)),
+			separator:   ";",
+			targetLabel: rule.TargetLabel,
+			replacement: "$1",
+			modulus:     rule.Modulus,
+		}
+		if compiled.action == "" {
+			compiled.action = relabelReplace
+		}
+		if rule.Separator != nil {
+			compiled.separator = *rule.Separator
+		}
+		if rule.Replacement != nil {
+			compiled.replacement = *rule.Replacement
+		}
+		for _, label := range strings.Split(rule.SourceLabels, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				compiled.sourceLabels = append(compiled.sourceLabels, label)
+			}
+		}
+
+		pattern := "(.*)"
+		if rule.Regex != nil {
+			pattern = *rule.Regex
+		}
+		regex, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("relabel rule %d: invalid regex: %w", i+1, err)
+		}
+		compiled.regex = regex
+
+		switch compiled.action {
+		case relabelReplace:
+			if compiled.targetLabel == "" {
+				return nil, fmt.Errorf("relabel rule %d: replace needs a target_label", i+1)
+			}
+		case relabelKeep, relabelDrop:
+			if len(compiled.sourceLabels) == 0 {
+				return nil, fmt.Errorf("relabel rule %d: %s needs source_labels", i+1, compiled.action)
+			}
+		case relabelHashMod:
+			if compiled.targetLabel == "" || compiled.modulus == 0 {
+				return nil, fmt.Errorf("relabel rule %d: hashmod needs a target_label and a modulus", i+1)
+			}
+		case relabelLabelMap, relabelLabelDrop, relabelLabelKeep:
+		default:
+			return nil, fmt.Errorf("relabel rule %d: unknown action %q (replace, keep, drop, labelmap, labeldrop, labelkeep or hashmod)", i+1, rule.Action)
+		}
+		rules = append(rules, compiled)
+	}
+	return rules, nil
+}
+
+// apply returns the samples that survive the rules, with their names and
+// labels rewritten. Samples are copied, never modified.
+func (r relabelRules) apply(samples []metricSample) []metricSample {
+	if len(r) == 0 {
+		return samples
+	}
+
+	result := make([]metricSample, 0, len(samples))
+	for _, sample := range samples {
+		labels := make(map[string]string, len(sample.Labels)+1)
+		for name, value := range sample.Labels {
+			labels[name] = value
+		}
+		labels["__name__"] = sample.Name
+
+		if !r.process(labels) || labels["__name__"] == "" {
+			continue
+		}
+
+		sample.Name = labels["__name__"]
+		delete(labels, "__name__")
+		sample.Labels = labels
+		result = append(result, sample)
+	}
+	return result
+}
+
+// process rewrites a label set in place and reports whether it is kept
+func (r relabelRules) process(labels map[string]string) bool {
+	for _, rule := range r {
+		values := make([]string, len(rule.sourceLabels))
+		for i, name := range rule.sourceLabels {
+			values[i] = labels[name]
+		}
+		source := strings.Join(values, rule.separator)
+
+		switch rule.action {
+		case relabelKeep:
+			if !rule.regex.MatchString(source) {
+				return false
+			}
+		case relabelDrop:
+			if rule.regex.MatchString(source) {
+				return false
+			}
+		case relabelReplace:
+			match := rule.regex.FindStringSubmatchIndex(source)
+			if match == nil {
+				continue
+			}
+			target := string(rule.regex.ExpandString(nil, rule.targetLabel, source, match))
+			value := string(rule.regex.ExpandString(nil, rule.replacement, source, match))
+			if value == "" {
+				delete(labels, target)
+			} else {
+				labels[target] = value
+			}
+		case relabelHashMod:
+			sum := md5.Sum([]byte(source))
+			labels[rule.targetLabel] = fmt.Sprint(binary.BigEndian.Uint64(sum[8:]) % rule.modulus)
+		case relabelLabelMap:
+			// Names are read before writing so a mapped label is not
+			// mapped again
+			names := make([]string, 0, len(labels))
+			for name := range labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			mapped := make(map[string]string)
+			for _, name := range names {
+				if match := rule.regex.FindStringSubmatchIndex(name); match != nil {
+					mapped[string(rule.regex.ExpandString(nil, rule.replacement, name, match))] = labels[name]
+				}
+			}
+			for name, value := range mapped {
+				labels[name] = value
+			}
+		case relabelLabelDrop, relabelLabelKeep:
+			for name := range labels {
+				if name == "__name__" {
+					continue
+				}
+				if rule.regex.MatchString(name) == (rule.action == relabelLabelDrop) {
+					delete(labels, name)
+				}
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func testRelabelRules(t *testing.T, rules string) relabelRules {
+	t.Helper()
+	var config RelabelConfigs
+	if err := xml.Unmarshal([]byte("<relabel_configs>"+rules+"</relabel_configs>"), &config); err != nil {
+		t.Fatalf("invalid rules: %v", err)
+	}
+	compiled, err := compileRelabelRules(config)
+	if err != nil {
+		t.Fatalf("compileRelabelRules: %v", err)
+	}
+	return compiled
+}
+
+func TestRelabelProcess(t *testing.T) {
+	tests := []struct {
+		name   string
+		rules  string
+		labels map[string]string
+		kept   bool
+		want   map[string]string
+	}{
+		{
+			"keep matching name",
+			`<rule action="keep" source_labels="__name__" regex="envoy_.*"/>`,
+			map[string]string{"__name__": "envoy_watts"},
+			true, map[string]string{"__name__": "envoy_watts"},
+		},
+		{
+			"keep is anchored",
+			`<rule action="keep" source_labels="__name__" regex="watts"/>`,
+			map[string]string{"__name__": "envoy_watts"},
+			false, nil,
+		},
+		{
+			"drop",
+			`<rule action="drop" source_labels="__name__" regex=".*_mw"/>`,
+			map[string]string{"__name__": "envoy_power_mw"},
+			false, nil,
+		},
+		{
+			"drop on joined labels",
+			`<rule action="drop" source_labels="gateway,phase" regex="house;l2"/>`,
+			map[string]string{"__name__": "m", "gateway": "house", "phase": "l2"},
+			false, nil,
+		},
+		{
+			"rename with default replace",
+			`<rule source_labels="__name__" regex="envoy_(.*)" target_label="__name__" replacement="solar_$1"/>`,
+			map[string]string{"__name__": "envoy_watts", "gateway": "house"},
+			true, map[string]string{"__name__": "solar_watts", "gateway": "house"},
+		},
+		{
+			"replace with separator",
+			`<rule source_labels="gateway,serial" separator="/" target_label="device"/>`,
+			map[string]string{"__name__": "m", "gateway": "house", "serial": "123"},
+			true, map[string]string{"__name__": "m", "gateway": "house", "serial": "123", "device": "house/123"},
+		},
+		{
+			"replace without match leaves labels",
+			`<rule source_labels="gateway" regex="garage" target_label="site" replacement="b"/>`,
+			map[string]string{"__name__": "m", "gateway": "house"},
+			true, map[string]string{"__name__": "m", "gateway": "house"},
+		},
+		{
+			"empty replacement removes the label",
+			`<rule source_labels="gateway" target_label="gateway_serial" replacement=""/>`,
+			map[string]string{"__name__": "m", "gateway": "house", "gateway_serial": "1"},
+			true, map[string]string{"__name__": "m", "gateway": "house"},
+		},
+		{
+			"labelmap",
+			`<rule action="labelmap" regex="gateway_(.*)" replacement="gw_$1"/>`,
+			map[string]string{"__name__": "m", "gateway_serial": "1"},
+			true, map[string]string{"__name__": "m", "gateway_serial": "1", "gw_serial": "1"},
+		},
+		{
+			"labeldrop keeps the name",
+			`<rule action="labeldrop" regex="gateway.*|__name__"/>`,
+			map[string]string{"__name__": "m", "gateway": "house", "gateway_serial": "1", "phase": "l1"},
+			true, map[string]string{"__name__": "m", "phase": "l1"},
+		},
+		{
+			"labelkeep",
+			`<rule action="labelkeep" regex="phase"/>`,
+			map[string]string{"__name__": "m", "gateway": "house", "phase": "l1"},
+			true, map[string]string{"__name__": "m", "phase": "l1"},
+		},
+		{
+			"hashmod",
+			`<rule action="hashmod" source_labels="serial" modulus="4" target_label="shard"/>`,
+			map[string]string{"__name__": "m", "serial": "122012345678"},
+			true, map[string]string{"__name__": "m", "serial": "122012345678", "shard": "2"},
+		},
+		{
+			"rules run in order",
+			`<rule source_labels="__name__" regex="envoy_(.*)" target_label="__name__" replacement="solar_$1"/>
+			 <rule action="keep" source_labels="__name__" regex="envoy_.*"/>`,
+			map[string]string{"__name__": "envoy_watts"},
+			false, nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := testRelabelRules(t, tt.rules)
+			labels := make(map[string]string)
+			for name, value := range tt.labels {
+				labels[name] = value
+			}
+			kept := rules.process(labels)
+			if kept != tt.kept {
+				t.Fatalf("kept = %v, want %v", kept, tt.kept)
+			}
+			if kept && !reflect.DeepEqual(labels, tt.want) {
+				t.Errorf("labels = %v, want %v", labels, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelabelApply(t *testing.T) {
+	rules := testRelabelRules(t, `
+		<rule source_labels="__name__" regex="envoy_inverter_.*" target_label="__name__" replacement=""/>
+		<rule source_labels="__name__" regex="envoy_(.*)" target_label="__name__" replacement="solar_$1"/>`)
+
+	original := map[string]string{"gateway": "house"}
+	samples := []metricSample{
+		{Name: "envoy_watts", Type: "gauge", Labels: original, Value: 1},
+		{Name: "envoy_inverter_watts", Type: "gauge", Labels: original, Value: 2},
+	}
+
+	got := rules.apply(samples)
+	if len(got) != 1 || got[0].Name != "solar_watts" || got[0].Value != 1 {
+		t.Fatalf("apply = %+v, want only solar_watts", got)
+	}
+	if _, ok := got[0].Labels["__name__"]; ok {
+		t.Errorf("__name__ left in the labels")
+	}
+	if samples[0].Name != "envoy_watts" || len(original) != 1 {
+		t.Errorf("apply modified its input")
+	}
+	if out := relabelRules(nil).apply(samples); len(out) != 2 {
+		t.Errorf("no rules dropped series")
+	}
+}
+
+func TestCompileRelabelRulesErrors(t *testing.T) {
+	tests := []string{
+		`<rule action="replace" source_labels="a"/>`,
+		`<rule action="keep"/>`,
+		`<rule action="hashmod" source_labels="a" target_label="b"/>`,
+		`<rule action="rename" source_labels="a"/>`,
+		`<rule action="drop" source_labels="a" regex="("/>`,
+	}
+	for _, rules := range tests {
+		var config RelabelConfigs
+		if err := xml.Unmarshal([]byte("<r>"+rules+"</r>"), &config); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := compileRelabelRules(config); err == nil {
+			t.Errorf("compileRelabelRules(%s) succeeded, want an error", rules)
+		}
+	}
+}
+
+func TestMQTTRelabelSection(t *testing.T) {
+	var config Config
+	err := xml.Unmarshal([]byte(`<envoy_config>
+		<relabel_configs>
+			<rule action="keep" source_labels="__name__" regex="envoy_.*"/>
+		</relabel_configs>
+		<mqtt enabled="true">
+			<relabel>
+				<rule action="drop" source_labels="__name__" regex="lifetime_wh"/>
+			</relabel>
+		</mqtt>
+	</envoy_config>`), &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Relabel.Rules) != 1 || len(config.MQTT.Relabel.Rules) != 1 {
+		t.Fatalf("rules = %d global, %d mqtt; want 1 each", len(config.Relabel.Rules), len(config.MQTT.Relabel.Rules))
+	}
+
+	mqttRules, err := compileRelabelRules(config.MQTT.Relabel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Gateway{name: "house"}
+	values := mqttRules.apply(mqttSeries(g, MQTTMetrics{CurrentWatts: 100, LifetimeWh: 5}))
+
+	// The global keep rule does not apply, the MQTT drop rule does
+	names := make(map[string]bool)
+	for _, value := range values {
+		names[value.Name] = true
+	}
+	if !names["current_watts"] || names["lifetime_wh"] || len(values) != 9 {
+		t.Errorf("published %v, want every value but lifetime_wh", names)
+	}
+}
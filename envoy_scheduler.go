@@ -0,0 +1,207 @@
+// envoy_scheduler.go - Background polling of gateway endpoints into snapshots
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPollInterval         = 30 // seconds
+	defaultMaxConcurrentQueries = 4
+	monitorPollInterval         = 30 * time.Second
+
+	// Endpoints behind /api/monitor, polled even when no query uses them
+	monitorProductionURL = "https://{envoy_ip}/api/v1/production"
+	monitorInvertersURL  = "https://{envoy_ip}/api/v1/production/inverters"
+	monitorLivedataURL   = "https://{envoy_ip}/ivp/livedata/status"
+)
+
+// pollTarget is one endpoint polled on its own interval. Queries sharing a
+// URL share the poll, at the shortest of their intervals and the longest of
+// their timeouts.
+type pollTarget struct {
+	url      string
+	interval time.Duration
+	timeout  time.Duration
+	format   responseFormat
+}
+
+// pollTargets lists the distinct endpoints needed by a query set, plus the
+// monitor endpoints when includeMonitor is set
+func (g *Gateway) pollTargets(queries []Query, includeMonitor bool) []pollTarget {
+	defaultInterval := time.Duration(g.config.PollInterval) * time.Second
+	if defaultInterval <= 0 {
+		defaultInterval = defaultPollInterval * time.Second
+	}
+	defaultTimeout := time.Duration(g.config.GatewayTimeout) * time.Second
+
+	var targets []pollTarget
+	index := make(map[string]int)
+	add := func(url string, interval time.Duration, timeout time.Duration, format responseFormat) {
+		if i, ok := index[url]; ok {
+			if interval < targets[i].interval {
+				targets[i].interval = interval
+			}
+			if timeout > targets[i].timeout {
+				targets[i].timeout = timeout
+			}
+			return
+		}
+		index[url] = len(targets)
+		targets = append(targets, pollTarget{url: url, interval: interval, timeout: timeout, format: format})
+	}
+
+	for _, query := range queries {
+		interval := defaultInterval
+		if query.Interval > 0 {
+			interval = time.Duration(query.Interval) * time.Second
+		}
+		timeout := defaultTimeout
+		if query.Timeout > 0 {
+			timeout = time.Duration(query.Timeout) * time.Second
+		}
+		// Formats were validated with the config
+		format, _ := queryFormat(query)
+		add(query.URL, interval, timeout, format)
+	}
+
+	if includeMonitor {
+		for _, url := range []string{monitorProductionURL, monitorInvertersURL, monitorLivedataURL} {
+			add(url, monitorPollInterval, defaultTimeout, responseFormat{kind: formatJSON})
+		}
+	}
+
+	return targets
+}
+
+// startScheduler polls every endpoint in the background. Start times are
+// staggered so the gateway never sees a burst of requests.
+func (g *Gateway) startScheduler() {
+	targets := g.pollTargets(g.config.Queries, true)
+	for i, target := range targets {
+		go g.pollLoop(target, time.Duration(i)*time.Second)
+	}
+	LogInfo("Gateway %s: polling %d endpoint(s)", g.name, len(targets))
+}
+
+// pollLoop refreshes one endpoint's snapshot until the gateway is stopped
+func (g *Gateway) pollLoop(target pollTarget, delay time.Duration) {
+	if !g.sleep(delay) {
+		return
+	}
+
+	ticker := time.NewTicker(target.interval)
+	defer ticker.Stop()
+
+	for {
+		g.updateSnapshot(g.fetchEndpoint(context.Background(), target))
+		select {
+		case <-ticker.C:
+		case <-g.stopped:
+			return
+		}
+	}
+}
+
+// fetchEndpoint requests and parses one endpoint once a worker slot is free.
+// The request is abandoned when ctx is done or the target's timeout passes.
+func (g *Gateway) fetchEndpoint(ctx context.Context, target pollTarget) *EndpointResult {
+	url := target.url
+	result := &EndpointResult{URL: url, FetchedAt: time.Now()}
+
+	select {
+	case g.workers <- struct{}{}:
+		defer func() { <-g.workers }()
+	case <-ctx.Done():
+		result.Err = fmt.Errorf("not started: %w", ctx.Err())
+		return result
+	}
+
+	if target.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, target.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	result.FetchedAt = start
+
+	data, status, err := g.makeEnvoyRequest(ctx, url, target.format)
+	result.Duration = time.Since(start)
+	result.Size = len(data)
+	result.StatusCode = status
+	if err != nil {
+		LogInfo("Failed to query %s on gateway %s: %v", url, g.name, err)
+		result.Err = err
+		return result
+	}
+
+	decoded, err := target.format.decode(data)
+	if err != nil {
+		LogInfo("Failed to parse response for %s on gateway %s: %v", url, g.name, err)
+		result.Err = err
+		return result
+	}
+	result.Data = decoded
+	result.IsJSON = target.format.kind == formatJSON
+
+	return result
+}
+
+// fetchEndpoints polls the endpoints of a query set concurrently, for /probe.
+// Cancelling ctx abandons the requests still outstanding.
+func (g *Gateway) fetchEndpoints(ctx context.Context, queries []Query) map[string]*EndpointResult {
+	targets := g.pollTargets(queries, false)
+	results := make([]*EndpointResult, len(targets))
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target pollTarget) {
+			defer wg.Done()
+			results[i] = g.fetchEndpoint(ctx, target)
+		}(i, target)
+	}
+	wg.Wait()
+
+	endpoints := make(map[string]*EndpointResult, len(results))
+	for _, result := range results {
+		endpoints[result.URL] = result
+	}
+	return endpoints
+}
+
+// updateSnapshot replaces the snapshot with one that includes the result
+func (g *Gateway) updateSnapshot(result *EndpointResult) {
+	g.updateMutex.Lock()
+	defer g.updateMutex.Unlock()
+
+	previous := g.currentSnapshot()
+	endpoints := make(map[string]*EndpointResult, len(previous.Endpoints)+1)
+	for url, existing := range previous.Endpoints {
+		endpoints[url] = existing
+	}
+	endpoints[result.URL] = result
+	g.recordQueryResults(result)
+
+	snapshot := &GatewaySnapshot{
+		Timestamp: time.Now(),
+		Endpoints: endpoints,
+		Metrics:   g.renderQueryMetrics(endpoints),
+		Monitor:   g.buildMonitorData(endpoints),
+	}
+
+	g.snapshotMutex.Lock()
+	g.snapshot = snapshot
+	g.snapshotMutex.Unlock()
+}
+
+// currentSnapshot returns the latest snapshot. It must not be modified.
+func (g *Gateway) currentSnapshot() *GatewaySnapshot {
+	g.snapshotMutex.RLock()
+	defer g.snapshotMutex.RUnlock()
+	return g.snapshot
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPollLoopStops(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write([]byte(`{"wattsNow": 1}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		delay time.Duration
+	}{
+		{"while polling", 0},
+		{"during the start delay", time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := newGateway("test", "test", Config{
+				EnvoyIP:  strings.TrimPrefix(server.URL, "http://"),
+				AuthMode: authModeNone,
+				WebDir:   t.TempDir(),
+				StateDir: t.TempDir(),
+			})
+			if err != nil {
+				t.Fatalf("newGateway: %v", err)
+			}
+
+			done := make(chan struct{})
+			go func() {
+				g.pollLoop(pollTarget{url: server.URL + "/api/v1/production", interval: time.Millisecond, format: responseFormat{kind: formatJSON}}, tt.delay)
+				close(done)
+			}()
+
+			time.Sleep(20 * time.Millisecond)
+			g.stop()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatalf("pollLoop still running after stop")
+			}
+
+			// No request starts once the loop has returned
+			before := requests.Load()
+			time.Sleep(20 * time.Millisecond)
+			if after := requests.Load(); after != before {
+				t.Errorf("%d requests after stop", after-before)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// envoy_session.go - Envoy session cookie authentication
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookieName    = "sessionId"
+	sessionMaxAge        = 1 * time.Hour    // renew the session this often
+	sessionRetryInterval = 15 * time.Minute // bearer fallback after a rejected session
+)
+
+// envoySession tracks the sessionId cookie obtained by exchanging the JWT at
+// /auth/check_jwt. The cookie itself lives in the HTTP client's cookie jar.
+type envoySession struct {
+	mutex         sync.Mutex
+	active        bool
+	token         string // token the session was established with
+	establishedAt time.Time
+	fallbackUntil time.Time
+	renewals      int
+	lastError     string
+	inflight      *sessionCall // exchange in progress, shared by concurrent callers
+}
+
+type sessionCall struct {
+	token  string
+	done   chan struct{}
+	active bool
+}
+
+func (g *Gateway) gatewayURL() *url.URL {
+	return &url.URL{Scheme: "https", Host: g.envoyIP(), Path: "/"}
+}
+
+// ensureSession makes sure a session exists for the token, establishing or
+// renewing it as needed. It returns false when requests should carry the
+// bearer header instead. The exchange runs outside the session lock and is
+// shared by concurrent callers; each stops waiting when its ctx is done.
+func (g *Gateway) ensureSession(ctx context.Context, token string) bool {
+	if token == "" || g.gatewayClient.Jar == nil {
+		return false
+	}
+
+	s := &g.session
+	s.mutex.Lock()
+	if s.active && s.token == token && time.Since(s.establishedAt) < sessionMaxAge {
+		s.mutex.Unlock()
+		return true
+	}
+	if time.Now().Before(s.fallbackUntil) {
+		s.mutex.Unlock()
+		return false
+	}
+	if call := s.inflight; call != nil {
+		s.mutex.Unlock()
+		if call.token != token {
+			return false
+		}
+		select {
+		case <-call.done:
+			return call.active
+		case <-ctx.Done():
+			return false
+		}
+	}
+	call := &sessionCall{token: token, done: make(chan struct{})}
+	s.inflight = call
+	renewal := s.active
+	s.mutex.Unlock()
+
+	err := g.establishSession(ctx, token)
+
+	s.mutex.Lock()
+	defer func() {
+		s.mutex.Unlock()
+		close(call.done)
+	}()
+
+	// A reset while exchanging makes the result stale
+	if s.inflight != call {
+		return false
+	}
+	s.inflight = nil
+
+	if err != nil {
+		s.active = false
+		if ctx.Err() != nil {
+			// The request gave up, not the gateway: let the next one retry
+			return false
+		}
+		s.lastError = err.Error()
+		s.fallbackUntil = time.Now().Add(sessionRetryInterval)
+		LogWarning("Envoy session unavailable, using bearer token: %v", err)
+		return false
+	}
+
+	s.active = true
+	s.token = token
+	s.establishedAt = time.Now()
+	s.lastError = ""
+	if renewal {
+		s.renewals++
+		LogDebug("Envoy session renewed")
+	} else {
+		LogInfo("Envoy session established")
+	}
+	call.active = true
+	return true
+}
+
+// establishSession exchanges the JWT for a session cookie
+func (g *Gateway) establishSession(ctx context.Context, token string) error {
+	g.clearSessionCookie()
+
+	if err := g.checkJWT(ctx, token); err != nil {
+		return err
+	}
+
+	for _, cookie := range g.gatewayClient.Jar.Cookies(g.gatewayURL()) {
+		if cookie.Name == sessionCookieName && cookie.Value != "" {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("gateway did not issue a %s cookie", sessionCookieName)
+}
+
+// dropSession discards a session the gateway rejected and falls back to
+// bearer headers for a while
+func (g *Gateway) dropSession(reason error) {
+	s := &g.session
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.active = false
+	s.inflight = nil
+	s.lastError = reason.Error()
+	s.fallbackUntil = time.Now().Add(sessionRetryInterval)
+	g.clearSessionCookie()
+}
+
+// resetSession forgets the session without the bearer fallback period, e.g.
+// because the gateway moved to a new address
+func (g *Gateway) resetSession() {
+	s := &g.session
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.active = false
+	s.inflight = nil
+	g.clearSessionCookie()
+}
+
+func (g *Gateway) clearSessionCookie() {
+	g.gatewayClient.Jar.SetCookies(g.gatewayURL(), []*http.Cookie{
+		{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1},
+	})
+}
+
+// sessionStatus reports the session state for /health
+func (g *Gateway) sessionStatus() map[string]interface{} {
+	s := &g.session
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := "inactive"
+	if s.active {
+		state = "active"
+	} else if time.Now().Before(s.fallbackUntil) {
+		state = "bearer_fallback"
+	}
+
+	status := map[string]interface{}{
+		"state":    state,
+		"renewals": s.renewals,
+	}
+	if s.active {
+		status["established_at"] = s.establishedAt.Unix()
+	}
+	if state == "bearer_fallback" {
+		status["retry_at"] = s.fallbackUntil.Unix()
+	}
+	if s.lastError != "" {
+		status["last_error"] = s.lastError
+	}
+	return status
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSessionGateway answers check_jwt once release is closed
+func testSessionGateway(t *testing.T, release chan struct{}, checks *atomic.Int32) *Gateway {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/auth/check_jwt" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		checks.Add(1)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "s", Path: "/"})
+		w.Write([]byte("<!DOCTYPE html><h2>Valid token.</h2>"))
+	}))
+	t.Cleanup(server.Close)
+
+	g, err := newGateway("test", "test", Config{
+		EnvoyIP:  strings.TrimPrefix(server.URL, "https://"),
+		Token:    "tok",
+		AuthMode: authModeJWT,
+		WebDir:   t.TempDir(),
+		StateDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("newGateway: %v", err)
+	}
+	return g
+}
+
+func TestEnsureSessionCoalesces(t *testing.T) {
+	release := make(chan struct{})
+	var checks atomic.Int32
+	g := testSessionGateway(t, release, &checks)
+
+	var wg sync.WaitGroup
+	var established atomic.Int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if g.ensureSession(context.Background(), "tok") {
+				established.Add(1)
+			}
+		}()
+	}
+
+	// The session lock is not held during the exchange
+	time.Sleep(50 * time.Millisecond)
+	if state := g.sessionStatus()["state"]; state != "inactive" {
+		t.Errorf("state during the exchange = %v, want inactive", state)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := checks.Load(); n != 1 {
+		t.Errorf("%d check_jwt exchanges, want 1", n)
+	}
+	if n := established.Load(); n != 5 {
+		t.Errorf("%d callers got the session, want 5", n)
+	}
+}
+
+func TestEnsureSessionHonoursContext(t *testing.T) {
+	release := make(chan struct{})
+	var checks atomic.Int32
+	g := testSessionGateway(t, release, &checks)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if g.ensureSession(ctx, "tok") {
+		t.Errorf("session established after the context expired")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("ensureSession took %v after its context expired", elapsed)
+	}
+
+	// Giving up is not a gateway failure: the next request tries again
+	if state := g.sessionStatus()["state"]; state == "bearer_fallback" {
+		t.Errorf("cancelled exchange put the session in bearer fallback")
+	}
+	close(release)
+	if !g.ensureSession(context.Background(), "tok") {
+		t.Errorf("session not established on the next request")
+	}
+}
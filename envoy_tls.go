@@ -0,0 +1,225 @@
+// envoy_tls.go - Gateway certificate verification (trust on first use)
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pinned gateway certificate, stored next to the production history
+const gatewayCertFileName = "envoy_gateway_cert.json"
+
+// Gateway certificate verification modes
+const (
+	certModeFingerprint = "fingerprint" // configured SHA-256 fingerprint
+	certModeCA          = "ca"          // configured CA bundle
+	certModeTOFU        = "tofu"        // pinned on first contact
+	certModeInsecure    = "insecure"    // no verification
+)
+
+// Persisted certificate pin
+type GatewayCertPin struct {
+	Fingerprint string `json:"fingerprint"`
+	Subject     string `json:"subject"`
+	NotAfter    int64  `json:"not_after"`
+	PinnedAt    int64  `json:"pinned_at"`
+}
+
+// gatewayCertVerifier checks the gateway's self-signed certificate against
+// a configured fingerprint or CA bundle, or pins it on first contact
+type gatewayCertVerifier struct {
+	mode     string
+	pinFile  string
+	expected string         // configured fingerprint
+	roots    *x509.CertPool // configured CA bundle
+
+	mutex    sync.Mutex
+	pinned   string
+	lastSeen string
+	mismatch bool
+}
+
+func newGatewayCertVerifier(config Config, pinFile string) (*gatewayCertVerifier, error) {
+	v := &gatewayCertVerifier{
+		pinFile: pinFile,
+	}
+
+	switch {
+	case config.GatewayTLS.Insecure:
+		v.mode = certModeInsecure
+	case config.GatewayTLS.Fingerprint != "":
+		v.mode = certModeFingerprint
+		v.expected = normalizeFingerprint(config.GatewayTLS.Fingerprint)
+		if len(v.expected) != sha256.Size*2 {
+			return nil, fmt.Errorf("gateway_tls fingerprint must be a SHA-256 hex digest")
+		}
+	case config.GatewayTLS.CAFile != "":
+		v.mode = certModeCA
+		pem, err := os.ReadFile(config.GatewayTLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gateway CA bundle: %w", err)
+		}
+		v.roots = x509.NewCertPool()
+		if !v.roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.GatewayTLS.CAFile)
+		}
+	default:
+		v.mode = certModeTOFU
+		v.loadPin()
+	}
+
+	return v, nil
+}
+
+// tlsConfig returns the TLS settings for gateway connections. Standard
+// verification is disabled because the gateway cert is self-signed and
+// addressed by IP; verifyConnection does the checking instead.
+func (v *gatewayCertVerifier) tlsConfig() *tls.Config {
+	return &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyConnection:   v.verifyConnection,
+	}
+}
+
+func (v *gatewayCertVerifier) verifyConnection(cs tls.ConnectionState) error {
+	if v.mode == certModeInsecure {
+		return nil
+	}
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("gateway presented no certificate")
+	}
+
+	leaf := cs.PeerCertificates[0]
+	fingerprint := certFingerprint(leaf)
+
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.lastSeen = fingerprint
+
+	switch v.mode {
+	case certModeFingerprint:
+		if fingerprint != v.expected {
+			v.mismatch = true
+			return fmt.Errorf("gateway certificate fingerprint %s does not match configured fingerprint %s",
+				formatFingerprint(fingerprint), formatFingerprint(v.expected))
+		}
+
+	case certModeCA:
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: v.roots, Intermediates: intermediates}); err != nil {
+			v.mismatch = true
+			return fmt.Errorf("gateway certificate not signed by configured CA: %w", err)
+		}
+
+	case certModeTOFU:
+		if v.pinned == "" {
+			v.pinned = fingerprint
+			v.savePin(leaf)
+			LogInfo("Pinned gateway certificate %s (trust on first use)", formatFingerprint(fingerprint))
+		} else if fingerprint != v.pinned {
+			v.mismatch = true
+			return fmt.Errorf("gateway certificate changed: got %s, pinned %s (remove %s to accept the new certificate)",
+				formatFingerprint(fingerprint), formatFingerprint(v.pinned), v.pinFile)
+		}
+	}
+
+	v.mismatch = false
+	return nil
+}
+
+func (v *gatewayCertVerifier) loadPin() {
+	data, err := os.ReadFile(v.pinFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			LogWarning("Failed to read gateway certificate pin: %v", err)
+		}
+		return
+	}
+
+	var pin GatewayCertPin
+	if err := json.Unmarshal(data, &pin); err != nil {
+		LogWarning("Failed to parse gateway certificate pin: %v", err)
+		return
+	}
+
+	v.pinned = normalizeFingerprint(pin.Fingerprint)
+	LogInfo("Loaded pinned gateway certificate %s", formatFingerprint(v.pinned))
+}
+
+func (v *gatewayCertVerifier) savePin(cert *x509.Certificate) {
+	pin := GatewayCertPin{
+		Fingerprint: formatFingerprint(v.pinned),
+		Subject:     cert.Subject.String(),
+		NotAfter:    cert.NotAfter.Unix(),
+		PinnedAt:    time.Now().Unix(),
+	}
+
+	data, err := json.MarshalIndent(pin, "", "  ")
+	if err != nil {
+		LogError("Failed to marshal gateway certificate pin: %v", err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(v.pinFile), 0700); err != nil {
+		LogError("Failed to create directory for gateway certificate pin: %v", err)
+		return
+	}
+	if err := os.WriteFile(v.pinFile, data, 0644); err != nil {
+		LogError("Failed to save gateway certificate pin: %v", err)
+	}
+}
+
+// status reports the verification state for /health
+func (v *gatewayCertVerifier) status() map[string]interface{} {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	status := map[string]interface{}{
+		"mode":     v.mode,
+		"mismatch": v.mismatch,
+	}
+	if v.lastSeen != "" {
+		status["fingerprint"] = formatFingerprint(v.lastSeen)
+	}
+	if v.pinned != "" {
+		status["pinned"] = formatFingerprint(v.pinned)
+	}
+	return status
+}
+
+func (v *gatewayCertVerifier) hasMismatch() bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.mismatch
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint accepts fingerprints with or without colons
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", " ", "").Replace(strings.TrimSpace(fingerprint)))
+}
+
+// formatFingerprint renders a fingerprint as colon separated upper-case hex
+func formatFingerprint(fingerprint string) string {
+	var parts []string
+	for i := 0; i+2 <= len(fingerprint); i += 2 {
+		parts = append(parts, strings.ToUpper(fingerprint[i:i+2]))
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,157 @@
+// envoy_token_state.go - Token persistence across restarts
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// State file in state_dir. It holds credentials, so it is written 0600.
+const tokenStateFileName = "envoy_token_state.json"
+
+// Persisted token state
+type TokenState struct {
+	Token   string `json:"token"`
+	Expires int64  `json:"expires"`
+	Source  string `json:"source"`
+	Serial  string `json:"serial"`
+	SavedAt int64  `json:"saved_at"`
+}
+
+func (g *Gateway) tokenStateFile() string {
+	return g.stateFile(tokenStateFileName)
+}
+
+// saveTokenState writes the active token to the state file
+func (g *Gateway) saveTokenState() {
+	g.tokenMutex.RLock()
+	state := TokenState{
+		Token:   g.token,
+		Expires: g.tokenExpires,
+		Source:  g.tokenSource,
+		Serial:  g.config.EnvoySerial,
+		SavedAt: time.Now().Unix(),
+	}
+	g.tokenMutex.RUnlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		LogError("Failed to marshal token state: %v", err)
+		return
+	}
+
+	stateFile := g.tokenStateFile()
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0700); err != nil {
+		LogError("Failed to create token state directory: %v", err)
+		return
+	}
+
+	// Write to temporary file first, then rename (atomic operation)
+	tempFile := stateFile + ".tmp"
+	if err := os.WriteFile(tempFile, data, 0600); err != nil {
+		LogError("Failed to write token state: %v", err)
+		return
+	}
+	if err := os.Rename(tempFile, stateFile); err != nil {
+		LogError("Failed to rename token state file: %v", err)
+		os.Remove(tempFile)
+		return
+	}
+
+	LogDebug("Token state saved to %s", stateFile)
+}
+
+// loadTokenState reads the state file
+func (g *Gateway) loadTokenState() (*TokenState, error) {
+	data, err := os.ReadFile(g.tokenStateFile())
+	if err != nil {
+		return nil, err
+	}
+
+	var state TokenState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse token state: %w", err)
+	}
+
+	if state.Token == "" {
+		return nil, fmt.Errorf("token state file holds no token")
+	}
+
+	return &state, nil
+}
+
+// restoreTokenState reuses a persisted token that is still valid. The token
+// is checked against the gateway's /auth/check_jwt endpoint first; if the
+// gateway cannot be reached the token is used provisionally and a rejection
+// is handled later by the normal re-authentication path.
+func (g *Gateway) restoreTokenState() error {
+	state, err := g.loadTokenState()
+	if err != nil {
+		return err
+	}
+
+	if state.Serial != "" && g.config.EnvoySerial != "" && state.Serial != g.config.EnvoySerial {
+		return fmt.Errorf("persisted token belongs to gateway %s", state.Serial)
+	}
+
+	if state.Expires > 0 && time.Until(time.Unix(state.Expires, 0)) < tokenRefreshWindow {
+		return fmt.Errorf("persisted token expires at %s", time.Unix(state.Expires, 0))
+	}
+
+	err = g.checkJWT(context.Background(), state.Token)
+	switch {
+	case err == nil:
+		LogInfo("Persisted token validated by gateway")
+	case isUnauthorized(err):
+		os.Remove(g.tokenStateFile())
+		return fmt.Errorf("gateway rejected persisted token: %w", err)
+	default:
+		LogWarning("Could not validate persisted token with gateway (%v), using it provisionally", err)
+	}
+
+	if err := g.applyToken(state.Token, state.Expires, state.Source); err != nil {
+		return err
+	}
+
+	LogInfo("Restored %s token from %s, expires at: %s", state.Source, g.tokenStateFile(), time.Unix(state.Expires, 0))
+	return nil
+}
+
+// checkJWT asks the gateway whether it accepts the token
+func (g *Gateway) checkJWT(ctx context.Context, token string) error {
+	url := "https://" + g.envoyIP() + "/auth/check_jwt"
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := g.gatewayClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode == http.StatusUnauthorized || isLoginPage(body) {
+		return fmt.Errorf("%w - token not accepted by gateway", errEnvoyUnauthorized)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from check_jwt", resp.StatusCode)
+	}
+	if !strings.Contains(string(body), "Valid token") {
+		return fmt.Errorf("%w - unexpected check_jwt response", errEnvoyUnauthorized)
+	}
+
+	g.tokenAccepted(token)
+	return nil
+}
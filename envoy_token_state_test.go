@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckStateDir(t *testing.T) {
+	tests := []struct {
+		stateDir, webDir string
+		errors           bool
+	}{
+		{"./state", "./web", false},
+		{"/var/lib/envoy-exporter", "/srv/web", false},
+		{"./web", "./web", true},
+		{"./web/state", "./web", true},
+		{"web/../web/state", "./web", true},
+		{"./web-state", "./web", false},
+		{"..", ".", false},
+		{"./state", ".", true},
+	}
+	for _, tt := range tests {
+		err := checkStateDir(tt.stateDir, tt.webDir)
+		if (err != nil) != tt.errors {
+			t.Errorf("checkStateDir(%q, %q) = %v, want error %v", tt.stateDir, tt.webDir, err, tt.errors)
+		}
+	}
+}
+
+func TestTokenStateFile(t *testing.T) {
+	webDir := t.TempDir()
+	stateDir := filepath.Join(t.TempDir(), "state")
+
+	// A token saved by an earlier version in the served directory
+	legacy := filepath.Join(webDir, "envoy_token_state_garage.json")
+	if err := os.WriteFile(legacy, []byte(`{"token":"old","expires":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := newGateway("garage", "garage", Config{WebDir: webDir, StateDir: stateDir, AuthMode: authModeNone})
+	if err != nil {
+		t.Fatalf("newGateway: %v", err)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Errorf("token state left in web_dir: %v", err)
+	}
+	state, err := g.loadTokenState()
+	if err != nil || state.Token != "old" {
+		t.Fatalf("loadTokenState = %+v, %v; want the moved state", state, err)
+	}
+
+	g.token = "new"
+	g.saveTokenState()
+	file := filepath.Join(stateDir, "envoy_token_state_garage.json")
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatalf("token state not saved in state_dir: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("token state mode = %v, want 0600", mode)
+	}
+	if entries, _ := os.ReadDir(webDir); len(entries) != 0 {
+		t.Errorf("web_dir holds %d files, want none", len(entries))
+	}
+}
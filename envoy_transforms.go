@@ -0,0 +1,315 @@
+// envoy_transforms.go - Built-in and configured value transforms
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transformFunc converts a field's value. A nil result produces no series.
+type transformFunc func(value interface{}) interface{}
+
+// signalStrengthTransform combines the two paths of a field, see
+// processMetric. Applied to a single value it leaves it unchanged.
+const signalStrengthTransform = "signal_strength_percentage"
+
+// builtinTransforms are available without a <transforms> section. A
+// configured transform of the same name replaces one.
+var builtinTransforms = []Transform{
+	{Name: "bool_to_int", Map: &TransformMap{Entries: []TransformMapEntry{{"true", 1}, {"false", 0}}}},
+	{Name: "mw_to_watts", Convert: &TransformConvert{From: "mW", To: "W"}},
+	{Name: "connected_to_int", Map: &TransformMap{Default: "0", Entries: []TransformMapEntry{{"connected", 1}}}},
+	{Name: "ok_to_int", Map: &TransformMap{Default: "0", Entries: []TransformMapEntry{{"ok", 1}}}},
+	{Name: "enabled_to_int", Map: &TransformMap{Default: "0", Entries: []TransformMapEntry{{"enabled", 1}}}},
+	{Name: "battery_state_to_int", Map: &TransformMap{Default: "0", Entries: []TransformMapEntry{{"charging", 1}, {"discharging", -1}}}},
+}
+
+// transformUnit relates a unit to its quantity's base unit:
+// base = (value + offset) * scale
+type transformUnit struct {
+	quantity string
+	scale    float64
+	offset   float64
+}
+
+var transformUnits = map[string]transformUnit{
+	"mW": {"power", 1e-3, 0}, "W": {"power", 1, 0}, "kW": {"power", 1e3, 0}, "MW": {"power", 1e6, 0},
+	"mWh": {"energy", 1e-3, 0}, "Wh": {"energy", 1, 0}, "kWh": {"energy", 1e3, 0}, "MWh": {"energy", 1e6, 0}, "J": {"energy", 1.0 / 3600, 0},
+	"VA": {"apparent power", 1, 0}, "kVA": {"apparent power", 1e3, 0},
+	"mV": {"voltage", 1e-3, 0}, "V": {"voltage", 1, 0}, "kV": {"voltage", 1e3, 0},
+	"mA": {"current", 1e-3, 0}, "A": {"current", 1, 0},
+	"C": {"temperature", 1, 273.15}, "F": {"temperature", 5.0 / 9, 459.67}, "K": {"temperature", 1, 0},
+	"ms": {"time", 1e-3, 0}, "s": {"time", 1, 0}, "min": {"time", 60, 0}, "h": {"time", 3600, 0}, "d": {"time", 86400, 0},
+	"%": {"ratio", 0.01, 0}, "ratio": {"ratio", 1, 0},
+}
+
+// compileTransforms builds the built-in and configured transforms, checking
+// patterns, units and chains
+func compileTransforms(config Transforms) (map[string]transformFunc, error) {
+	definitions := make(map[string]Transform)
+	for _, transform := range builtinTransforms {
+		definitions[transform.Name] = transform
+	}
+
+	configured := make(map[string]bool)
+	for i, transform := range config.Transforms {
+		if transform.Name == "" {
+			return nil, fmt.Errorf("transform %d has no name", i+1)
+		}
+		if configured[transform.Name] {
+			return nil, fmt.Errorf("duplicate transform name %q", transform.Name)
+		}
+		configured[transform.Name] = true
+
+		if transform.kinds() == 0 {
+			if _, builtin := definitions[transform.Name]; builtin || transform.Name == signalStrengthTransform {
+				continue
+			}
+			return nil, fmt.Errorf("transform %s defines no map, scale, convert, regex, timestamp or chain", transform.Name)
+		}
+		definitions[transform.Name] = transform
+	}
+
+	compiled := map[string]transformFunc{
+		signalStrengthTransform: func(value interface{}) interface{} { return value },
+	}
+	var compile func(name string, chain []string) (transformFunc, error)
+	compile = func(name string, chain []string) (transformFunc, error) {
+		if apply, ok := compiled[name]; ok {
+			return apply, nil
+		}
+		for _, previous := range chain {
+			if previous == name {
+				return nil, fmt.Errorf("transform chain %s loops", strings.Join(append(chain, name), " -> "))
+			}
+		}
+		transform, ok := definitions[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+		apply, err := transform.compile(func(step string) (transformFunc, error) {
+			return compile(step, append(chain[:len(chain):len(chain)], name))
+		})
+		if err != nil {
+			return nil, err
+		}
+		compiled[name] = apply
+		return apply, nil
+	}
+
+	names := make([]string, 0, len(definitions))
+	for name := range definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := compile(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return compiled, nil
+}
+
+func (t Transform) kinds() int {
+	count := 0
+	for _, set := range []bool{t.Map != nil, t.Scale != nil, t.Convert != nil, t.Regex != nil, t.Timestamp != nil, strings.TrimSpace(t.Chain) != ""} {
+		if set {
+			count++
+		}
+	}
+	return count
+}
+
+// compile builds a transform; lookup resolves the steps of a chain
+func (t Transform) compile(lookup func(name string) (transformFunc, error)) (transformFunc, error) {
+	if t.kinds() > 1 {
+		return nil, fmt.Errorf("transform %s sets more than one conversion; chain separate transforms instead", t.Name)
+	}
+
+	switch {
+	case t.Map != nil:
+		entries := make(map[string]float64, len(t.Map.Entries))
+		for _, entry := range t.Map.Entries {
+			entries[entry.Key] = entry.Value
+		}
+		var fallback interface{}
+		if t.Map.Default != "" {
+			value, ok := sampleValue(t.Map.Default)
+			if !ok {
+				return nil, fmt.Errorf("transform %s: default %q is not a number", t.Name, t.Map.Default)
+			}
+			fallback = value
+		}
+		return func(value interface{}) interface{} {
+			if mapped, ok := entries[labelText(value)]; ok {
+				return mapped
+			}
+			return fallback
+		}, nil
+
+	case t.Scale != nil:
+		factor := 1.0
+		if t.Scale.Factor != nil {
+			factor = *t.Scale.Factor
+		}
+		offset := t.Scale.Offset
+		return numericTransform(func(f float64) float64 {
+			return f*factor + offset
+		}), nil
+
+	case t.Convert != nil:
+		from, ok := transformUnits[t.Convert.From]
+		if !ok {
+			return nil, fmt.Errorf("transform %s: unknown unit %q", t.Name, t.Convert.From)
+		}
+		to, ok := transformUnits[t.Convert.To]
+		if !ok {
+			return nil, fmt.Errorf("transform %s: unknown unit %q", t.Name, t.Convert.To)
+		}
+		if from.quantity != to.quantity {
+			return nil, fmt.Errorf("transform %s: cannot convert %s (%s) to %s (%s)", t.Name, t.Convert.From, from.quantity, t.Convert.To, to.quantity)
+		}
+		return numericTransform(func(f float64) float64 {
+			// 12 significant digits hide the rounding of the offsets
+			converted := (f+from.offset)*from.scale/to.scale - to.offset
+			rounded, _ := strconv.ParseFloat(strconv.FormatFloat(converted, 'g', 12, 64), 64)
+			return rounded
+		}), nil
+
+	case t.Regex != nil:
+		pattern, err := regexp.Compile(t.Regex.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("transform %s: invalid pattern: %w", t.Name, err)
+		}
+		group := pattern.SubexpIndex("value")
+		if group < 0 && pattern.NumSubexp() > 0 {
+			group = 1
+		}
+		if group < 0 {
+			group = 0
+		}
+		return func(value interface{}) interface{} {
+			match := pattern.FindStringSubmatch(labelText(value))
+			if match == nil {
+				return nil
+			}
+			return textValue(match[group])
+		}, nil
+
+	case t.Timestamp != nil:
+		return timestampTransform(t)
+
+	default:
+		var steps []transformFunc
+		for _, name := range strings.Split(t.Chain, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			step, err := lookup(name)
+			if err != nil {
+				return nil, fmt.Errorf("transform %s: %w", t.Name, err)
+			}
+			steps = append(steps, step)
+		}
+		return func(value interface{}) interface{} {
+			for _, step := range steps {
+				if value == nil {
+					return nil
+				}
+				value = step(value)
+			}
+			return value
+		}, nil
+	}
+}
+
+// numericTransform applies fn to numbers and numeric strings; other values
+// produce no series
+func numericTransform(fn func(float64) float64) transformFunc {
+	return func(value interface{}) interface{} {
+		f, ok := sampleValue(value)
+		if !ok {
+			return nil
+		}
+		return fn(f)
+	}
+}
+
+func timestampTransform(t Transform) (transformFunc, error) {
+	location := time.UTC
+	if t.Timestamp.Location != "" {
+		var err error
+		if location, err = time.LoadLocation(t.Timestamp.Location); err != nil {
+			return nil, fmt.Errorf("transform %s: %w", t.Name, err)
+		}
+	}
+
+	switch strings.ToLower(t.Timestamp.Layout) {
+	case "unix":
+		return numericTransform(func(f float64) float64 { return f }), nil
+	case "unix_ms":
+		return numericTransform(func(f float64) float64 { return f / 1000 }), nil
+	case "":
+		return nil, fmt.Errorf("transform %s: timestamp needs a layout", t.Name)
+	}
+
+	layout := t.Timestamp.Layout
+	if strings.EqualFold(layout, "rfc3339") {
+		layout = time.RFC3339
+	}
+	return func(value interface{}) interface{} {
+		parsed, err := time.ParseInLocation(layout, labelText(value), location)
+		if err != nil {
+			return nil
+		}
+		return float64(parsed.UnixNano()) / 1e9
+	}, nil
+}
+
+// transformValue applies a named transform. Names are checked when the
+// configuration is loaded.
+func (g *Gateway) transformValue(value interface{}, transform string) interface{} {
+	apply, ok := g.transforms[transform]
+	if !ok {
+		LogWarning("Gateway %s: unknown transform %q", g.name, transform)
+		return nil
+	}
+	return apply(value)
+}
+
+// validateTransforms compiles the transforms and rejects references to ones
+// that are not defined
+func validateTransforms(transforms Transforms, queries []Query) error {
+	compiled, err := compileTransforms(transforms)
+	if err != nil {
+		return err
+	}
+
+	known := func(metric, name string) error {
+		if name == "" {
+			return nil
+		}
+		if _, ok := compiled[name]; !ok {
+			return fmt.Errorf("metric %s: unknown transform %q", metric, name)
+		}
+		return nil
+	}
+	for _, query := range queries {
+		for _, metric := range query.Metrics {
+			if err := known(metric.Name, metric.Transform); err != nil {
+				return err
+			}
+			for _, field := range metric.Fields {
+				if err := known(metric.Name, field.Transform); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
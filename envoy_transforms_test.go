@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/xml"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTransformConfig(t *testing.T, transforms string) Transforms {
+	t.Helper()
+	var config Transforms
+	if err := xml.Unmarshal([]byte("<transforms>"+transforms+"</transforms>"), &config); err != nil {
+		t.Fatalf("invalid transforms: %v", err)
+	}
+	return config
+}
+
+func TestTransforms(t *testing.T) {
+	compiled, err := compileTransforms(testTransformConfig(t, `
+		<transform name="grid_state"><map default="-1"><entry key="on" value="1"/><entry key="off" value="0"/></map></transform>
+		<transform name="phase"><map><entry key="l1" value="1"/></map></transform>
+		<transform name="deciwatts"><scale factor="0.1"/></transform>
+		<transform name="plus_offset"><scale offset="5"/></transform>
+		<transform name="c_to_f"><convert from="C" to="F"/></transform>
+		<transform name="wh_to_kwh"><convert from="Wh" to="kWh"/></transform>
+		<transform name="percent"><convert from="%" to="ratio"/></transform>
+		<transform name="firmware_major"><regex pattern="^D?(\d+)\."/></transform>
+		<transform name="firmware_minor"><regex pattern="^D?\d+\.(?P&lt;value&gt;\d+)"/></transform>
+		<transform name="whole_match"><regex pattern="\d+"/></transform>
+		<transform name="rfc3339"><timestamp layout="rfc3339"/></transform>
+		<transform name="millis"><timestamp layout="unix_ms"/></transform>
+		<transform name="scaled_milliwatts"><chain>mw_to_watts, deciwatts</chain></transform>
+		<transform name="major_plus_five"><chain>firmware_major,plus_offset</chain></transform>
+		<transform name="ok_to_int"><description>documents the built-in</description></transform>
+	`))
+	if err != nil {
+		t.Fatalf("compileTransforms: %v", err)
+	}
+
+	tests := []struct {
+		transform string
+		value     interface{}
+		want      interface{}
+	}{
+		{"grid_state", "on", 1.0},
+		{"grid_state", "off", 0.0},
+		{"grid_state", "tripped", -1.0},
+		{"phase", "l2", nil},
+		{"phase", "l1", 1.0},
+		{"bool_to_int", true, 1.0},
+		{"bool_to_int", false, 0.0},
+		{"connected_to_int", "disconnected", 0.0},
+		{"ok_to_int", "ok", 1.0},
+		{"battery_state_to_int", "discharging", -1.0},
+		{"deciwatts", 1234.0, 123.4},
+		{"deciwatts", "20", 2.0},
+		{"deciwatts", "n/a", nil},
+		{"plus_offset", 1.0, 6.0},
+		{"mw_to_watts", 2500.0, 2.5},
+		{"c_to_f", 20.0, 68.0},
+		{"c_to_f", 37.0, 98.6},
+		{"c_to_f", -40.0, -40.0},
+		{"wh_to_kwh", 1500.0, 1.5},
+		{"percent", 45.0, 0.45},
+		{"firmware_major", "D7.6.175", 7.0},
+		{"firmware_minor", "D7.6.175", 6.0},
+		{"firmware_major", "unknown", nil},
+		{"whole_match", "serial 122012345678", 122012345678.0},
+		{"rfc3339", "2024-01-02T03:04:05Z", 1704164645.0},
+		{"rfc3339", "yesterday", nil},
+		{"millis", 1704164645500.0, 1704164645.5},
+		{"scaled_milliwatts", "15000", 1.5},
+		{"major_plus_five", "D7.6.175", 12.0},
+		{"major_plus_five", "unknown", nil},
+		{signalStrengthTransform, 3.0, 3.0},
+	}
+
+	for _, tt := range tests {
+		apply, ok := compiled[tt.transform]
+		if !ok {
+			t.Errorf("transform %s not compiled", tt.transform)
+			continue
+		}
+		if got := apply(tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s(%v) = %#v, want %#v", tt.transform, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestTimestampLocation(t *testing.T) {
+	if _, err := time.LoadLocation("America/New_York"); err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	compiled, err := compileTransforms(testTransformConfig(t,
+		`<transform name="local_date"><timestamp layout="2006-01-02 15:04" location="America/New_York"/></transform>`))
+	if err != nil {
+		t.Fatalf("compileTransforms: %v", err)
+	}
+	if got := compiled["local_date"]("2024-01-02 03:04"); got != 1704182640.0 {
+		t.Errorf("local_date = %v, want 1704182640 (08:04 UTC)", got)
+	}
+}
+
+func TestCompileTransformsErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		transforms string
+		message    string
+	}{
+		{"unnamed", `<transform><scale factor="2"/></transform>`, "has no name"},
+		{"duplicate", `<transform name="a"><scale/></transform><transform name="a"><scale/></transform>`, "duplicate"},
+		{"empty", `<transform name="a"/>`, "defines no map"},
+		{"several kinds", `<transform name="a"><scale/><regex pattern="x"/></transform>`, "more than one"},
+		{"bad default", `<transform name="a"><map default="high"/></transform>`, "not a number"},
+		{"unknown unit", `<transform name="a"><convert from="hp" to="W"/></transform>`, `unknown unit "hp"`},
+		{"other quantity", `<transform name="a"><convert from="W" to="Wh"/></transform>`, "cannot convert"},
+		{"bad pattern", `<transform name="a"><regex pattern="("/></transform>`, "invalid pattern"},
+		{"no layout", `<transform name="a"><timestamp/></transform>`, "needs a layout"},
+		{"bad location", `<transform name="a"><timestamp layout="unix" location="Nowhere/Else"/></transform>`, "transform a"},
+		{"unknown step", `<transform name="a"><chain>nope</chain></transform>`, `unknown transform "nope"`},
+		{"self loop", `<transform name="a"><chain>a</chain></transform>`, "a -> a"},
+		{"cycle", `<transform name="a"><chain>b</chain></transform><transform name="b"><chain>mw_to_watts, a</chain></transform>`, "loops"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileTransforms(testTransformConfig(t, tt.transforms))
+			if err == nil || !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("error = %v, want one containing %q", err, tt.message)
+			}
+		})
+	}
+}
+
+func TestValidateTransforms(t *testing.T) {
+	transforms := testTransformConfig(t, `<transform name="double"><scale factor="2"/></transform>`)
+	tests := []struct {
+		metric Metric
+		errors bool
+	}{
+		{Metric{Name: "m", Transform: "double"}, false},
+		{Metric{Name: "m", Transform: "bool_to_int"}, false},
+		{Metric{Name: "m", Fields: []Field{{Transform: "double"}}}, false},
+		{Metric{Name: "m", Transform: "triple"}, true},
+		{Metric{Name: "m", Fields: []Field{{Transform: "triple"}}}, true},
+	}
+	for _, tt := range tests {
+		err := validateTransforms(transforms, []Query{{Name: "q", Metrics: []Metric{tt.metric}}})
+		if (err != nil) != tt.errors {
+			t.Errorf("validateTransforms(%+v) = %v, want error %v", tt.metric, err, tt.errors)
+		}
+	}
+}
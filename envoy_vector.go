@@ -0,0 +1,215 @@
+// envoy_vector.go - Labelled series in calculated metrics
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// exprSeries is one labelled value of a vector
+type exprSeries struct {
+	Labels map[string]string
+	Value  float64
+}
+
+// exprVector holds the series of a metric, or the result of an operation
+// on them
+type exprVector []exprSeries
+
+// labelMatching restricts the labels that pair series of two vectors:
+// on(...) uses only the listed labels, ignoring(...) all but them
+type labelMatching struct {
+	on     bool
+	labels []string
+}
+
+// labelGrouping selects the labels an aggregation keeps: by(...) keeps the
+// listed labels, without(...) all but them
+type labelGrouping struct {
+	without bool
+	labels  []string
+}
+
+func containsLabel(labels []string, name string) bool {
+	for _, label := range labels {
+		if label == name {
+			return true
+		}
+	}
+	return false
+}
+
+// labelKey identifies a label set, restricted to the names kept by keep
+func labelKey(labels map[string]string, keep func(string) bool) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if keep(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var key strings.Builder
+	for _, name := range names {
+		key.WriteString(name)
+		key.WriteByte('=')
+		key.WriteString(labels[name])
+		key.WriteByte(0xff)
+	}
+	return key.String()
+}
+
+func (m *labelMatching) key(labels map[string]string) string {
+	return labelKey(labels, func(name string) bool {
+		if m == nil {
+			return true
+		}
+		return containsLabel(m.labels, name) == m.on
+	})
+}
+
+// keeps reports whether an aggregation keeps a label
+func (g *labelGrouping) keeps(name string) bool {
+	if g == nil {
+		return false
+	}
+	return containsLabel(g.labels, name) != g.without
+}
+
+func isEmptyVector(value interface{}) bool {
+	vector, ok := value.(exprVector)
+	return ok && len(vector) == 0
+}
+
+// combine applies fn per series. Numbers and vectors holding one series
+// apply to every series; the series of vectors holding several pair up by
+// their labels, and series without a partner are dropped. The result takes
+// the labels of the first vector with the most series, and is a number
+// when every argument is one.
+func combine(args []interface{}, matching *labelMatching, fn func([]float64) (float64, error)) (interface{}, error) {
+	values := make([]float64, len(args))
+
+	shape := -1
+	for i, arg := range args {
+		switch v := arg.(type) {
+		case float64:
+		case exprVector:
+			if shape < 0 || (len(args[shape].(exprVector)) == 1 && len(v) != 1) {
+				shape = i
+			}
+		default:
+			return nil, fmt.Errorf("%q is not a number", arg)
+		}
+	}
+
+	if shape < 0 {
+		for i, arg := range args {
+			values[i] = arg.(float64)
+		}
+		return fn(values)
+	}
+
+	// Index the other vectors with several series by their labels
+	indexes := make([]map[string]float64, len(args))
+	for i, arg := range args {
+		vector, ok := arg.(exprVector)
+		if !ok || i == shape || len(vector) == 1 {
+			continue
+		}
+		indexes[i] = make(map[string]float64, len(vector))
+		for _, series := range vector {
+			key := matching.key(series.Labels)
+			if _, duplicate := indexes[i][key]; duplicate {
+				return nil, fmt.Errorf("several series share the labels %s; pair them with on() or ignoring()", formatSeriesLabels(series.Labels))
+			}
+			indexes[i][key] = series.Value
+		}
+	}
+
+	result := make(exprVector, 0, len(args[shape].(exprVector)))
+	for _, series := range args[shape].(exprVector) {
+		key := matching.key(series.Labels)
+		matched := true
+		for i, arg := range args {
+			switch v := arg.(type) {
+			case float64:
+				values[i] = v
+			case exprVector:
+				switch {
+				case i == shape:
+					values[i] = series.Value
+				case indexes[i] == nil:
+					values[i] = v[0].Value
+				default:
+					values[i], matched = indexes[i][key]
+				}
+			}
+			if !matched {
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		// A series that cannot be computed, such as a division by zero,
+		// is dropped rather than failing the others
+		value, err := fn(values)
+		if err != nil {
+			continue
+		}
+		result = append(result, exprSeries{Labels: series.Labels, Value: value})
+	}
+	return result, nil
+}
+
+// aggregate reduces the series of a vector, to one series or one per group
+// of the labels the grouping keeps. A number is its own aggregate.
+func aggregate(arg interface{}, grouping *labelGrouping, fn func([]float64) float64) (interface{}, error) {
+	switch v := arg.(type) {
+	case float64:
+		return fn([]float64{v}), nil
+	case exprVector:
+		var order []string
+		groups := make(map[string][]float64)
+		labels := make(map[string]map[string]string)
+		for _, series := range v {
+			key := labelKey(series.Labels, grouping.keeps)
+			if _, ok := groups[key]; !ok {
+				order = append(order, key)
+				kept := make(map[string]string)
+				for name, value := range series.Labels {
+					if grouping.keeps(name) {
+						kept[name] = value
+					}
+				}
+				labels[key] = kept
+			}
+			groups[key] = append(groups[key], series.Value)
+		}
+
+		result := make(exprVector, 0, len(order))
+		for _, key := range order {
+			result = append(result, exprSeries{Labels: labels[key], Value: fn(groups[key])})
+		}
+		return result, nil
+	default:
+		return nil, fmt.Errorf("%q is not a number", arg)
+	}
+}
+
+// formatSeriesLabels renders a label set for messages
+func formatSeriesLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=%q", name, labels[name]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
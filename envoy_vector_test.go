@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// formatSeries renders a number, or the series of a vector as sorted
+// "labels value" entries
+func formatSeries(value interface{}) string {
+	vector, ok := value.(exprVector)
+	if !ok {
+		return fmt.Sprintf("%g", value)
+	}
+	lines := make([]string, 0, len(vector))
+	for _, series := range vector {
+		lines = append(lines, fmt.Sprintf("%s %g", formatSeriesLabels(series.Labels), series.Value))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, " ")
+}
+
+func TestVectorOperations(t *testing.T) {
+	env := testEnv(map[string]interface{}{
+		"production": exprVector{
+			{Labels: map[string]string{"phase": "l1", "meter": "prod"}, Value: 100},
+			{Labels: map[string]string{"phase": "l2", "meter": "prod"}, Value: 200},
+		},
+		"consumption": exprVector{
+			{Labels: map[string]string{"phase": "l1", "meter": "cons"}, Value: 40},
+			{Labels: map[string]string{"phase": "l2", "meter": "cons"}, Value: 0},
+		},
+		"limit": exprVector{
+			{Labels: map[string]string{"phase": "l1"}, Value: 150},
+			{Labels: map[string]string{"phase": "l3"}, Value: 150},
+		},
+		"total": exprVector{
+			{Labels: map[string]string{"site": "house"}, Value: 300},
+		},
+		"inverters": exprVector{
+			{Labels: map[string]string{"type": "pcu", "serial": "A1"}, Value: 200},
+			{Labels: map[string]string{"type": "pcu", "serial": "A2"}, Value: 0},
+			{Labels: map[string]string{"type": "acb", "serial": "B1"}, Value: 50},
+		},
+		"none": exprVector{},
+	})
+
+	tests := []struct {
+		name string
+		expr string
+		want string
+	}{
+		{"scalar", "production * 2", `{meter="prod",phase="l1"} 200 {meter="prod",phase="l2"} 400`},
+		{"unmatched labels", "production - consumption", ""},
+		{"on", "production - on(phase) consumption", `{meter="prod",phase="l1"} 60 {meter="prod",phase="l2"} 200`},
+		{"ignoring", "production - ignoring(meter) consumption", `{meter="prod",phase="l1"} 60 {meter="prod",phase="l2"} 200`},
+		{"series without partner dropped", "production / on(phase) limit", `{meter="prod",phase="l1"} 0.6666666666666666`},
+		{"division by zero drops the series", "production / on(phase) consumption", `{meter="prod",phase="l1"} 2.5`},
+		{"single series broadcast", "production / total", `{meter="prod",phase="l1"} 0.3333333333333333 {meter="prod",phase="l2"} 0.6666666666666666`},
+		{"function per series", "clamp(0, 150, production)", `{meter="prod",phase="l1"} 100 {meter="prod",phase="l2"} 150`},
+		{"sum", "sum(production)", "{} 300"},
+		{"count", "count(inverters)", "{} 3"},
+		{"avg aggregates one vector", "avg(production)", "{} 150"},
+		{"max aggregates one vector", "max(inverters)", "{} 200"},
+		{"sum by", "sum(inverters) by (type)", `{type="acb"} 50 {type="pcu"} 200`},
+		{"sum by before arguments", "sum by (type) (inverters)", `{type="acb"} 50 {type="pcu"} 200`},
+		{"count without", "count without (serial) (inverters)", `{type="acb"} 1 {type="pcu"} 2`},
+		{"min by", "min(inverters) by (type)", `{type="acb"} 50 {type="pcu"} 0`},
+		{"aggregate of a number", "sum(5)", "5"},
+		{"aggregate of nothing", "sum(none)", ""},
+		{"aggregates combine", "sum(production) - sum(consumption)", "{} 260"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := evaluateSeries(tt.expr, env)
+			if err != nil {
+				t.Fatalf("evaluateSeries(%q): %v", tt.expr, err)
+			}
+			if formatted := formatSeries(got); formatted != tt.want {
+				t.Errorf("evaluateSeries(%q) = %s, want %s", tt.expr, formatted, tt.want)
+			}
+		})
+	}
+}
+
+func TestVectorDuplicateLabels(t *testing.T) {
+	env := testEnv(map[string]interface{}{
+		"a": exprVector{
+			{Labels: map[string]string{"phase": "l1", "meter": "prod"}, Value: 1},
+			{Labels: map[string]string{"phase": "l1", "meter": "cons"}, Value: 2},
+		},
+		"b": exprVector{
+			{Labels: map[string]string{"phase": "l1", "meter": "prod"}, Value: 1},
+			{Labels: map[string]string{"phase": "l2", "meter": "prod"}, Value: 2},
+		},
+	})
+
+	// Matching on phase alone leaves two series of a with the same key
+	if _, err := evaluateSeries("b + on(phase) a", env); err == nil {
+		t.Errorf("duplicate series on the matching labels did not fail")
+	}
+	if _, err := evaluateNumber("a + 1", env); err == nil {
+		t.Errorf("evaluateNumber accepted a vector")
+	}
+}
@@ -61,7 +61,7 @@ func (e *EnvoyExporter) createDefaultWebFiles() {
         <div class="info-grid">
             <div class="info-card">
                 <h4>System Information</h4>
-                <p><strong>Envoy IP:</strong> ` + e.config.EnvoyIP + `</p>
+                <p><strong>Envoy IP:</strong> ` + e.primaryEnvoyIP() + `</p>
                 <p><strong>Port:</strong> ` + e.config.Port + `</p>
                 <p><strong>Location:</strong> ` + fmt.Sprintf("%.6f, %.6f", e.config.Latitude, e.config.Longitude) + `</p>
             </div>
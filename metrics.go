@@ -3,23 +3,21 @@ package main
 import (
 	"net/http"
 	"strings"
-	"strconv"
 	"fmt"
-	"encoding/json"
 	"math"
 	"time"
 )
 
-func (e *EnvoyExporter) processMetric(metric Metric, data interface{}, metrics *strings.Builder) {
+// processMetric adds the series of one metric for one query item. Paths are
+// read from the item; its ancestors supply parent fields.
+func (g *Gateway) processMetric(metric Metric, item jsonPathMatch, set *metricSet) {
+	data := item.Value
+
 	// Check condition
-	if !e.checkCondition(metric.Condition, data) {
+	if !g.checkCondition(metric.Condition, data) {
 		return
 	}
 
-	// Write help and type
-	metrics.WriteString(fmt.Sprintf("# HELP %s %s\n", metric.Name, metric.Help))
-	metrics.WriteString(fmt.Sprintf("# TYPE %s %s\n", metric.Name, metric.Type))
-
 	// Handle different field configurations
 	if len(metric.Fields) == 0 {
 		// Static value metric
@@ -27,378 +25,392 @@ func (e *EnvoyExporter) processMetric(metric Metric, data interface{}, metrics *
 		if metric.Value != "" {
 			value = metric.Value
 		}
-		metrics.WriteString(fmt.Sprintf("%s %s\n", metric.Name, value))
+		if f, ok := sampleValue(value); ok {
+			set.add(metric.Name, metric.Type, metric.Help, g.metricLabels(nil), f)
+		} else {
+			LogDebug("Metric %s: static value %q is not numeric", metric.Name, value)
+		}
 		return
 	}
 
-	// Process fields
-	labels := make(map[string]string)
-	var metricValue interface{}
-
-	for _, field := range metric.Fields {
+	// The last field without a label carries the value; a path selecting
+	// several nodes produces one series per node
+	var valueField *Field
+	var labelFields []Field
+	for i, field := range metric.Fields {
 		if field.Label != "" {
-			// This field is a label
-			labelValue := e.getJSONPathValue(data, field.JSONPath)
-			if field.LabelValue != "" {
-				labels[field.Label] = field.LabelValue
-			} else if labelValue != nil {
-				labels[field.Label] = fmt.Sprintf("%v", labelValue)
-			}
+			labelFields = append(labelFields, field)
 		} else {
-			// This field is the metric value
-			metricValue = e.getJSONPathValue(data, field.JSONPath)
-			if field.Transform != "" {
-				metricValue = e.transformValue(metricValue, field.Transform)
-			}
+			valueField = &metric.Fields[i]
 		}
 	}
 
-	// Handle special transforms that need multiple values
-	for _, field := range metric.Fields {
-		if field.Transform == "signal_strength_percentage" && strings.Contains(field.JSONPath, ",") {
-			paths := strings.Split(field.JSONPath, ",")
+	var matches []jsonPathMatch
+	if valueField != nil {
+		if valueField.Transform == "signal_strength_percentage" && strings.Contains(valueField.JSONPath, ",") {
+			// Special transform that needs two values
+			paths := strings.Split(valueField.JSONPath, ",")
 			if len(paths) == 2 {
-				strength := e.getJSONPathValue(data, paths[0])
-				maxStrength := e.getJSONPathValue(data, paths[1])
+				strength := g.getJSONPathValue(data, paths[0])
+				maxStrength := g.getJSONPathValue(data, paths[1])
 				if s, ok := strength.(float64); ok {
 					if m, ok := maxStrength.(float64); ok && m > 0 {
-						metricValue = (s / m) * 100
+						matches = []jsonPathMatch{item.child((s / m) * 100)}
 					}
 				}
 			}
+		} else {
+			var err error
+			matches, err = evaluateJSONPathFrom(item, valueField.JSONPath)
+			if err != nil {
+				LogDebug("Metric %s: %v", metric.Name, err)
+				return
+			}
+			if valueField.Transform != "" {
+				for i := range matches {
+					matches[i].Value = g.transformValue(matches[i].Value, valueField.Transform)
+				}
+			}
+		}
+
+		// A metric's transform applies after its value field's
+		if metric.Transform != "" {
+			for i := range matches {
+				if matches[i].Value != nil {
+					matches[i].Value = g.transformValue(matches[i].Value, metric.Transform)
+				}
+			}
 		}
 	}
 
 	// Use static value if no fields provided a value
-	if metricValue == nil && metric.Value != "" {
-		metricValue = metric.Value
+	if len(matches) == 0 && metric.Value != "" {
+		matches = []jsonPathMatch{item.child(metric.Value)}
 	}
 
-	// Format labels
-	labelStr := ""
-	if len(labels) > 0 {
-		labelParts := make([]string, 0, len(labels))
-		for key, value := range labels {
-			labelParts = append(labelParts, fmt.Sprintf("%s=\"%s\"", key, value))
+	for i, match := range matches {
+		if match.Value == nil {
+			continue
+		}
+
+		value, ok := sampleValue(match.Value)
+		if !ok {
+			LogDebug("Metric %s: value %v is not numeric", metric.Name, match.Value)
+			continue
 		}
-		labelStr = "{" + strings.Join(labelParts, ",") + "}"
-	}
 
-	// Output metric
-	if metricValue != nil {
-		metrics.WriteString(fmt.Sprintf("%s%s %v\n", metric.Name, labelStr, metricValue))
-
-		// Cache metric for calculated metrics
-		e.cacheMutex.Lock()
-		if f, ok := metricValue.(float64); ok {
-			e.metricCache[metric.Name] = f
-		} else if i, ok := metricValue.(int); ok {
-			e.metricCache[metric.Name] = float64(i)
-		} else if s, ok := metricValue.(string); ok {
-			if f, err := strconv.ParseFloat(s, 64); err == nil {
-				e.metricCache[metric.Name] = f
+		labels := g.labels()
+		for _, field := range labelFields {
+			if field.LabelValue != "" {
+				labels[field.Label] = field.LabelValue
+			} else if labelValue := g.seriesLabelValue(item, field.JSONPath, match, i, len(matches)); labelValue != nil {
+				labels[field.Label] = labelText(labelValue)
 			}
 		}
-		e.cacheMutex.Unlock()
-	}
-}
 
-func (e *EnvoyExporter) processArrayMetrics(metric Metric, dataArray []interface{}, metrics *strings.Builder) {
-	for _, item := range dataArray {
-		e.processMetric(metric, item, metrics)
+		set.add(metric.Name, metric.Type, metric.Help, labels, value)
 	}
 }
 
-// Add this to your metrics.go file to include version metrics
+// seriesLabelValue resolves a label field for the series built from the
+// index-th of count value matches. A path starting with @ is read from the
+// object holding the value, so sibling fields label wildcard matches, and
+// one starting with ^ from the object enclosing the item (^^ goes a level
+// further up). Other paths are read from the item: when they select as many
+// nodes as the value path, they pair up by position; otherwise the first
+// node is used.
+func (g *Gateway) seriesLabelValue(item jsonPathMatch, path string, match jsonPathMatch, index int, count int) interface{} {
+	if strings.HasPrefix(path, "@") {
+		parent := match.parent()
+		if parent == nil {
+			return nil
+		}
+		return g.getJSONPathValue(parent, path)
+	}
 
-func (e *EnvoyExporter) serveMetrics(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if levels, rest := parentPath(path); levels > 0 {
+		enclosing := enclosingObject(item, levels)
+		if enclosing == nil {
+			return nil
+		}
+		return g.getJSONPathValue(enclosing, rest)
+	}
 
-	var metrics strings.Builder
-	
-	// Clear metric cache
-	e.cacheMutex.Lock()
-	e.metricCache = make(map[string]float64)
-	e.cacheMutex.Unlock()
+	labels, err := evaluateJSONPathFrom(item, path)
+	if err != nil {
+		LogDebug("Gateway %s: %v", g.name, err)
+		return nil
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	if count > 1 && len(labels) == count {
+		return labels[index].Value
+	}
+	return labels[0].Value
+}
 
-	// Process all configured queries
-	for _, query := range e.config.Queries {
-		data, err := e.makeEnvoyRequest(query.URL)
-		if err != nil {
-			LogInfo("Failed to query %s: %v", query.Name, err)
-			continue
+// queryItems lists what a query's metrics are evaluated against: the
+// elements named by array_path, the elements of a top-level array when
+// array="true", or else the whole document
+func (g *Gateway) queryItems(query Query, data interface{}) []jsonPathMatch {
+	root := jsonPathMatch{Value: data}
+
+	switch {
+	case query.ArrayPath != "":
+		return g.arrayItems(root, query.ArrayPath)
+	case query.Array:
+		if _, ok := data.([]interface{}); !ok {
+			return nil
 		}
+		return children(root)
+	default:
+		return []jsonPathMatch{root}
+	}
+}
 
-		// Parse JSON data
-		var jsonData interface{}
-		if err := json.Unmarshal(data, &jsonData); err != nil {
-			LogInfo("Failed to parse JSON for %s: %v", query.Name, err)
-			continue
-		}
-		
-		// Check if endpoint is accessible (for condition evaluation)
-		if !e.checkCondition(query.Condition, jsonData) {
-			LogInfo("Condition not met for query %s, skipping", query.Name)
-			continue
-		}
+// arrayItems evaluates an array_path below a node. Arrays it selects are
+// replaced by their elements, so "production" and "production[*]" are the
+// same, and "[*].devices" walks the devices of every top-level entry.
+func (g *Gateway) arrayItems(from jsonPathMatch, path string) []jsonPathMatch {
+	matches, err := evaluateJSONPathFrom(from, path)
+	if err != nil {
+		LogDebug("Gateway %s: %v", g.name, err)
+		return nil
+	}
 
-		// Process metrics for this query
-		for _, metric := range query.Metrics {
-			if query.Array {
-				if arr, ok := jsonData.([]interface{}); ok {
-					e.processArrayMetrics(metric, arr, &metrics)
-				}
-			} else {
-				e.processMetric(metric, jsonData, &metrics)
-			}
+	var items []jsonPathMatch
+	for _, match := range matches {
+		if _, ok := match.Value.([]interface{}); ok {
+			items = append(items, children(match)...)
+		} else if match.Value != nil {
+			items = append(items, match)
 		}
 	}
-	
-	// Process calculated metrics
-	e.processCalculatedMetrics(&metrics)
+	return items
+}
+
+// metricsHandler serves /metrics. Every gateway contributes its own series,
+// labelled with its name. The query metrics come from the last poll; nothing
+// is fetched during a scrape.
+func (e *EnvoyExporter) metricsHandler() http.Handler {
+	return samplesHandler(func() []metricSample {
+		return e.relabel.apply(e.collectSamples())
+	})
+}
+
+func (e *EnvoyExporter) collectSamples() []metricSample {
+	set := &metricSet{}
+
+	for _, gateway := range e.gateways {
+		set.samples = append(set.samples, gateway.currentSnapshot().Metrics...)
+		gateway.writeStatusMetrics(set)
+	}
 
 	// Add version and build information metrics
-	e.addVersionMetrics(&metrics)
+	e.addVersionMetrics(set)
 
 	// Add exporter info
-	metrics.WriteString("# HELP envoy_exporter_up Exporter up status\n")
-	metrics.WriteString("# TYPE envoy_exporter_up gauge\n")
-	metrics.WriteString("envoy_exporter_up 1\n")
-	
-	metrics.WriteString("# HELP envoy_token_expires_timestamp Token expiry timestamp\n")
-	metrics.WriteString("# TYPE envoy_token_expires_timestamp gauge\n")
-	metrics.WriteString(fmt.Sprintf("envoy_token_expires_timestamp %d\n", e.tokenExpires))
-	
-	metrics.WriteString("# HELP envoy_scrape_timestamp Timestamp of this scrape\n")
-	metrics.WriteString("# TYPE envoy_scrape_timestamp gauge\n")
-	metrics.WriteString(fmt.Sprintf("envoy_scrape_timestamp %d\n", time.Now().Unix()))
+	set.add("envoy_exporter_up", "gauge", "Exporter up status", nil, 1)
+	set.add("envoy_scrape_timestamp", "gauge", "Timestamp of this scrape", nil, float64(time.Now().Unix()))
 
 	// Add MQTT status metrics
 	if e.config.MQTT.Enabled {
-		metrics.WriteString("# HELP envoy_mqtt_enabled MQTT publishing enabled\n")
-		metrics.WriteString("# TYPE envoy_mqtt_enabled gauge\n")
-		metrics.WriteString("envoy_mqtt_enabled 1\n")
-		
-		mqttConnected := 0
+		set.add("envoy_mqtt_enabled", "gauge", "MQTT publishing enabled", nil, 1)
+
+		mqttConnected := 0.0
 		if e.mqttPublisher != nil && e.mqttPublisher.IsConnected() {
 			mqttConnected = 1
 		}
-		
-		metrics.WriteString("# HELP envoy_mqtt_connected MQTT broker connection status\n")
-		metrics.WriteString("# TYPE envoy_mqtt_connected gauge\n")
-		metrics.WriteString(fmt.Sprintf("envoy_mqtt_connected %d\n", mqttConnected))
-		
+		set.add("envoy_mqtt_connected", "gauge", "MQTT broker connection status", nil, mqttConnected)
+
 		if e.mqttPublisher != nil && e.mqttPublisher.lastPublish > 0 {
-			metrics.WriteString("# HELP envoy_mqtt_last_publish_timestamp Last MQTT publish timestamp\n")
-			metrics.WriteString("# TYPE envoy_mqtt_last_publish_timestamp gauge\n")
-			metrics.WriteString(fmt.Sprintf("envoy_mqtt_last_publish_timestamp %d\n", e.mqttPublisher.lastPublish))
+			set.add("envoy_mqtt_last_publish_timestamp", "gauge", "Last MQTT publish timestamp", nil,
+				float64(e.mqttPublisher.lastPublish))
 		}
 	} else {
-		metrics.WriteString("# HELP envoy_mqtt_enabled MQTT publishing enabled\n")
-		metrics.WriteString("# TYPE envoy_mqtt_enabled gauge\n")
-		metrics.WriteString("envoy_mqtt_enabled 0\n")
+		set.add("envoy_mqtt_enabled", "gauge", "MQTT publishing enabled", nil, 0)
 	}
 
-	w.Write([]byte(metrics.String()))
+	return set.samples
 }
 
-func (e *EnvoyExporter) processCalculatedMetrics(metrics *strings.Builder) {
-	e.cacheMutex.RLock()
-	defer e.cacheMutex.RUnlock()
+// renderQueryMetrics collects the metrics of every query whose endpoint was
+// polled successfully, followed by the calculated metrics
+func (g *Gateway) renderQueryMetrics(endpoints map[string]*EndpointResult) []metricSample {
+	g.collectMutex.Lock()
+	defer g.collectMutex.Unlock()
+
+	set := &metricSet{}
+
+	// Clear metric cache
+	g.cacheMutex.Lock()
+	g.metricCache = make(map[string]exprVector)
+	g.cacheMutex.Unlock()
 
-	for _, calc := range e.config.CalculatedMetrics.Metrics {
-		// Check condition
-		if !e.checkCalculatedCondition(calc.Condition) {
+	// Process all configured queries
+	for _, query := range g.config.Queries {
+		result := endpoints[query.URL]
+		if result == nil || result.Data == nil {
 			continue
 		}
+		jsonData := result.Data
 
-		value := e.evaluateCalculation(calc.Calculation)
-		if !math.IsNaN(value) {
-			metrics.WriteString(fmt.Sprintf("# HELP %s %s\n", calc.Name, calc.Help))
-			metrics.WriteString(fmt.Sprintf("# TYPE %s %s\n", calc.Name, calc.Type))
-			metrics.WriteString(fmt.Sprintf("%s %.2f\n", calc.Name, value))
+		// Check if endpoint is accessible (for condition evaluation)
+		if !g.checkCondition(query.Condition, jsonData) {
+			LogDebug("Condition not met for query %s, skipping", query.Name)
+			continue
 		}
-	}
-}
-
-func (e *EnvoyExporter) checkCalculatedCondition(condition string) bool {
-	if condition == "" {
-		return true
-	}
 
-	switch condition {
-	case "pv_producing":
-		return e.metricCache["envoy_pv_power_watts"] > 0
-	case "load_present":
-		return e.metricCache["envoy_load_power_watts"] > 0
-	case "storage_present":
-		_, exists := e.metricCache["envoy_storage_power_watts"]
-		return exists
-	default:
-		return true
-	}
-}
+		// Process metrics for this query
+		items := g.queryItems(query, jsonData)
+		for _, metric := range query.Metrics {
+			start := len(set.samples)
+			g.collectMetric(metric, items, set)
 
-func (e *EnvoyExporter) evaluateCalculation(calc string) float64 {
-	// Simple expression evaluator for basic calculations
-	// Replace metric names with values
-	expression := calc
-	for metricName, value := range e.metricCache {
-		expression = strings.ReplaceAll(expression, metricName, fmt.Sprintf("%.2f", value))
+			// Cache the series for calculated metrics and conditions
+			g.cacheMutex.Lock()
+			for _, sample := range set.samples[start:] {
+				g.metricCache[metric.Name] = append(g.metricCache[metric.Name], exprSeries{Labels: sample.Labels, Value: sample.Value})
+			}
+			g.cacheMutex.Unlock()
+		}
 	}
 
-	// Handle functions
-	expression = e.replaceFunctions(expression)
+	// Process calculated metrics
+	g.processCalculatedMetrics(set)
 
-	// Basic expression evaluation (simplified)
-	return e.evaluateExpression(expression)
+	return set.samples
 }
 
-func (e *EnvoyExporter) replaceFunctions(expr string) string {
-	// Handle max(0, value)
-	for strings.Contains(expr, "max(0,") {
-		start := strings.Index(expr, "max(0,")
-		if start == -1 {
-			break
-		}
+// writeStatusMetrics adds the gateway's query health, authentication,
+// certificate and address state. None of it requires a request to the Envoy.
+func (g *Gateway) writeStatusMetrics(set *metricSet) {
+	g.writeQueryMetrics(set)
+
+	// Token metrics only apply to JWT firmware
+	if g.config.AuthMode == authModeJWT {
+		g.tokenMutex.RLock()
+		tokenExpires := g.tokenExpires
+		tokenScope := g.tokenScope
+		tokenSource := g.tokenSource
+		g.tokenMutex.RUnlock()
+
+		set.add("envoy_token_expires_timestamp", "gauge", "Token expiry timestamp",
+			g.metricLabels(nil), float64(tokenExpires))
+		set.add("envoy_token_info", "gauge", "Envoy token scope (owner/installer) and source",
+			g.metricLabels(map[string]string{"scope": tokenScope, "source": tokenSource}), 1)
+	}
 
-		// Find matching closing parenthesis
-		depth := 0
-		end := start + 6
-		for i := start + 6; i < len(expr); i++ {
-			if expr[i] == '(' {
-				depth++
-			} else if expr[i] == ')' {
-				if depth == 0 {
-					end = i
-					break
-				}
-				depth--
-			}
-		}
+	certMismatch := 0.0
+	if g.certVerifier.hasMismatch() {
+		certMismatch = 1
+	}
+	set.add("envoy_gateway_certificate_mismatch", "gauge",
+		"Gateway TLS certificate does not match the pinned or configured one", g.metricLabels(nil), certMismatch)
+
+	g.addressMutex.RLock()
+	address := g.address
+	addressSource := g.addressSource
+	addressChanges := g.addressChanges
+	g.addressMutex.RUnlock()
+
+	if address != "" {
+		set.add("envoy_gateway_address_info", "gauge",
+			"Current gateway address and how it was obtained (static or mdns)",
+			g.metricLabels(map[string]string{"address": address, "source": addressSource}), 1)
+	}
 
-		// Extract the value part
-		valuePart := strings.TrimSpace(expr[start+6 : end])
-		value := e.evaluateExpression(valuePart)
-		result := math.Max(0, value)
+	set.add("envoy_gateway_address_changes_total", "counter",
+		"Number of times the gateway moved to a new address", g.metricLabels(nil), float64(addressChanges))
+}
 
-		expr = expr[:start] + fmt.Sprintf("%.2f", result) + expr[end+1:]
+// processCalculatedMetrics evaluates the calculations in order. Metrics are
+// vectors of their labelled series, so a calculation may produce several
+// series. Each result is cached, so a calculation may use the ones before
+// it. A calculation referencing an undefined metric produces no series
+// rather than a zero.
+func (g *Gateway) processCalculatedMetrics(set *metricSet) {
+	g.cacheMutex.Lock()
+	defer g.cacheMutex.Unlock()
+
+	env := func(name string) (interface{}, bool) {
+		value, ok := g.metricCache[name]
+		return value, ok
 	}
 
-	// Handle clamp(min, max, value)
-	for strings.Contains(expr, "clamp(") {
-		start := strings.Index(expr, "clamp(")
-		if start == -1 {
-			break
+	for _, calc := range g.config.CalculatedMetrics.Metrics {
+		// Check condition; cacheMutex is already held
+		if !g.conditionHolds(calc.Condition, nil) {
+			continue
 		}
 
-		depth := 0
-		end := start + 6
-		for i := start + 6; i < len(expr); i++ {
-			if expr[i] == '(' {
-				depth++
-			} else if expr[i] == ')' {
-				if depth == 0 {
-					end = i
-					break
-				}
-				depth--
+		var series exprVector
+		result, err := evaluateSeries(calc.Calculation, env)
+		switch v := result.(type) {
+		case float64:
+			series = exprVector{{Labels: g.metricLabels(nil), Value: v}}
+		case exprVector:
+			for _, s := range v {
+				// Aggregations drop labels; the gateway's are always kept
+				series = append(series, exprSeries{Labels: g.metricLabels(s.Labels), Value: s.Value})
 			}
 		}
 
-		// Parse clamp arguments
-		args := strings.Split(expr[start+6:end], ",")
-		if len(args) == 3 {
-			min := e.evaluateExpression(strings.TrimSpace(args[0]))
-			max := e.evaluateExpression(strings.TrimSpace(args[1]))
-			value := e.evaluateExpression(strings.TrimSpace(args[2]))
-			result := math.Max(min, math.Min(max, value))
-			expr = expr[:start] + fmt.Sprintf("%.2f", result) + expr[end+1:]
-		}
-	}
-
-	// Handle coalesce(value, default)
-	for strings.Contains(expr, "coalesce(") {
-		start := strings.Index(expr, "coalesce(")
-		if start == -1 {
-			break
-		}
-
-		depth := 0
-		end := start + 9
-		for i := start + 9; i < len(expr); i++ {
-			if expr[i] == '(' {
-				depth++
-			} else if expr[i] == ')' {
-				if depth == 0 {
-					end = i
-					break
-				}
-				depth--
+		valid := exprVector{}
+		for _, s := range series {
+			if math.IsNaN(s.Value) || math.IsInf(s.Value, 0) {
+				continue
 			}
+			valid = append(valid, s)
+			set.add(calc.Name, calc.Type, calc.Help, s.Labels, math.Round(s.Value*100)/100)
 		}
+		if err == nil && len(valid) == 0 {
+			err = fmt.Errorf("no series")
+		}
+		g.reportCalculation(calc.Name, err)
 
-		args := strings.Split(expr[start+9:end], ",")
-		if len(args) == 2 {
-			value := e.evaluateExpression(strings.TrimSpace(args[0]))
-			defaultVal := e.evaluateExpression(strings.TrimSpace(args[1]))
-			if math.IsNaN(value) || value == 0 {
-				value = defaultVal
-			}
-			expr = expr[:start] + fmt.Sprintf("%.2f", value) + expr[end+1:]
+		up := 0.0
+		if err == nil {
+			g.metricCache[calc.Name] = valid
+			up = 1
 		}
+		set.add("envoy_calculated_metric_valid", "gauge",
+			"Whether the calculation produced a value (0 when it references an undefined metric or fails)",
+			g.metricLabels(map[string]string{"metric": calc.Name}), up)
 	}
-
-	return expr
 }
 
-func (e *EnvoyExporter) evaluateExpression(expr string) float64 {
-	expr = strings.TrimSpace(expr)
-
-	// Handle simple arithmetic operations
-	if strings.Contains(expr, "+") {
-		parts := strings.Split(expr, "+")
-		if len(parts) == 2 {
-			left := e.evaluateExpression(strings.TrimSpace(parts[0]))
-			right := e.evaluateExpression(strings.TrimSpace(parts[1]))
-			return left + right
-		}
+// reportCalculation logs when a calculation starts or stops failing, so a
+// missing input is visible without repeating on every poll. The caller
+// holds cacheMutex.
+func (g *Gateway) reportCalculation(name string, err error) {
+	message := ""
+	if err != nil {
+		message = err.Error()
 	}
-
-	if strings.Contains(expr, "-") && !strings.HasPrefix(expr, "-") {
-		parts := strings.Split(expr, "-")
-		if len(parts) == 2 {
-			left := e.evaluateExpression(strings.TrimSpace(parts[0]))
-			right := e.evaluateExpression(strings.TrimSpace(parts[1]))
-			return left - right
-		}
+	if g.calculationErrors[name] == message {
+		return
 	}
+	g.calculationErrors[name] = message
 
-	if strings.Contains(expr, "*") {
-		parts := strings.Split(expr, "*")
-		if len(parts) == 2 {
-			left := e.evaluateExpression(strings.TrimSpace(parts[0]))
-			right := e.evaluateExpression(strings.TrimSpace(parts[1]))
-			return left * right
-		}
+	switch e := err.(type) {
+	case nil:
+		LogInfo("Gateway %s: calculated metric %s has a value again", g.name, name)
+	case *undefinedError:
+		LogInfo("Gateway %s: calculated metric %s skipped, %s is not defined", g.name, name, e.Name)
+	default:
+		LogWarning("Gateway %s: calculated metric %s failed: %v", g.name, name, err)
 	}
+}
 
-	if strings.Contains(expr, "/") {
-		parts := strings.Split(expr, "/")
-		if len(parts) == 2 {
-			left := e.evaluateExpression(strings.TrimSpace(parts[0]))
-			right := e.evaluateExpression(strings.TrimSpace(parts[1]))
-			if right != 0 {
-				return left / right
-			}
+// validateCalculations parses every calculation so syntax errors are
+// reported at startup
+func validateCalculations(metrics []CalculatedMetric) error {
+	for _, calc := range metrics {
+		if _, err := compileExpression(calc.Calculation); err != nil {
+			return fmt.Errorf("calculated metric %s: %w", calc.Name, err)
 		}
 	}
-
-	// Try to parse as number
-	if f, err := strconv.ParseFloat(expr, 64); err == nil {
-		return f
-	}
-
-	return math.NaN()
+	return nil
 }
-
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"net/http"
 	"sync"
@@ -11,26 +12,102 @@ import (
 type Config struct {
 	XMLName            xml.Name            `xml:"envoy_config"`
 	User               string              `xml:"user"`
-	Password           string              `xml:"password"`
+	Password           string              `xml:"password" secret:"true"`
+	Token              string              `xml:"token" secret:"true"` // Long-lived owner token (optional)
+	TokenFile          string              `xml:"token_file"` // Path to a file holding the token (optional)
+	TokenEnv           string              `xml:"token_env"`  // Environment variable holding the token (optional)
+	AuthMode           string              `xml:"auth_mode"`       // jwt (default), digest or none
+	DigestUser         string              `xml:"digest_user"`     // envoy (default) or installer
+	DigestPassword     string              `xml:"digest_password" secret:"true"` // derived from the serial when empty
 	EnvoySerial        string              `xml:"envoy_serial"`
-	EnvoyIP            string              `xml:"envoy_ip"`
+	EnvoyIP            string              `xml:"envoy_ip"` // discovered via mDNS when empty
 	Port               string              `xml:"port"`
 	WebDir             string              `xml:"web_dir"`
+	StateDir           string              `xml:"state_dir"` // token state and certificate pins, never served
 	Latitude           float64             `xml:"latitude"`
 	Longitude          float64             `xml:"longitude"`
 	Timezone           string              `xml:"timezone"`
+	Cloud              CloudConfig         `xml:"cloud"`
+	GatewayTimeout     int                 `xml:"gateway_timeout"` // seconds, default 30
+	PollInterval       int                 `xml:"poll_interval"`   // seconds between query polls, default 30
+	MaxConcurrentQueries int               `xml:"max_concurrent_queries"` // requests in flight per gateway, default 4
+	GatewayTLS         GatewayTLSConfig    `xml:"gateway_tls"`
 	MQTT               MQTTConfig          `xml:"mqtt"`                // ADD THIS LINE
+	Gateways           GatewaysConfig      `xml:"gateways"`
+	AuthModules        AuthModules         `xml:"auth_modules"` // credentials for /probe targets
+	Probe              ProbeConfig         `xml:"probe"`
+	Discovery          DiscoveryConfig     `xml:"discovery"`
 	Queries            []Query             `xml:"query"`
 	CalculatedMetrics  CalculatedMetrics   `xml:"calculated_metrics"`
 	Transforms         Transforms          `xml:"transforms"`
 	Conditions         Conditions          `xml:"conditions"`
+	Relabel            RelabelConfigs      `xml:"relabel_configs"`
+}
+
+// Multiple gateways polled by one exporter. Without a <gateways> section the
+// top-level envoy_ip/envoy_serial/credentials describe a single gateway.
+type GatewaysConfig struct {
+	Gateways []GatewayConfig `xml:"gateway"`
+}
+
+// Per-gateway settings; empty fields inherit the top-level value
+type GatewayConfig struct {
+	Name           string           `xml:"name,attr"`
+	EnvoyIP        string           `xml:"envoy_ip"`
+	EnvoySerial    string           `xml:"envoy_serial"`
+	User           string           `xml:"user"`
+	Password       string           `xml:"password" secret:"true"`
+	Token          string           `xml:"token" secret:"true"`
+	TokenFile      string           `xml:"token_file"`
+	TokenEnv       string           `xml:"token_env"`
+	AuthMode       string           `xml:"auth_mode"`
+	DigestUser     string           `xml:"digest_user"`
+	DigestPassword string           `xml:"digest_password" secret:"true"`
+	GatewayTLS     GatewayTLSConfig `xml:"gateway_tls"`
+	Queries        []Query          `xml:"query"` // replaces the top-level query set when present
+}
+
+// Named credentials selected with /probe?auth_module=
+type AuthModules struct {
+	Modules []AuthModule `xml:"auth_module"`
+}
+
+// Settings applied to a probed gateway. Credentials come only from the
+// module; other empty fields inherit the top-level value.
+type AuthModule struct {
+	Name           string           `xml:"name,attr"`
+	Targets        string           `xml:"targets"` // comma-separated host patterns the module may be sent to
+	EnvoySerial    string           `xml:"envoy_serial"`
+	User           string           `xml:"user"`
+	Password       string           `xml:"password" secret:"true"`
+	Token          string           `xml:"token" secret:"true"`
+	TokenFile      string           `xml:"token_file"`
+	TokenEnv       string           `xml:"token_env"`
+	AuthMode       string           `xml:"auth_mode"`
+	DigestUser     string           `xml:"digest_user"`
+	DigestPassword string           `xml:"digest_password" secret:"true"`
+	GatewayTLS     GatewayTLSConfig `xml:"gateway_tls"`
+	Queries        []Query          `xml:"query"` // replaces the top-level query set when present
+}
+
+// Limits of the /probe endpoint
+type ProbeConfig struct {
+	Targets              string `xml:"targets"`               // host patterns for modules without their own
+	AllowUnauthenticated bool   `xml:"allow_unauthenticated"` // probe without auth_module, sending no credentials
+	MaxTargets           int    `xml:"max_targets"`           // targets cached at once, default 32
+	IdleTimeout          int    `xml:"idle_timeout"`          // seconds before an unused target is dropped, default 600
 }
 
 type Query struct {
 	Name      string   `xml:"name,attr"`
 	URL       string   `xml:"url,attr"`
 	Array     bool     `xml:"array,attr"`
+	ArrayPath string   `xml:"array_path,attr"` // arrays to iterate, see arrayItems
+	Format    string   `xml:"format,attr"`  // json (default), xml or text
+	Pattern   string   `xml:"pattern,attr"` // regex with named groups, for text
 	Condition string   `xml:"condition,attr"`
+	Interval  int      `xml:"interval,attr"` // poll interval in seconds, default poll_interval
+	Timeout   int      `xml:"timeout,attr"`  // request timeout in seconds, default gateway_timeout
 	Metrics   []Metric `xml:"metric"`
 }
 
@@ -41,6 +118,9 @@ type Metric struct {
 	Labels    string  `xml:"labels,attr"`
 	Transform string  `xml:"transform,attr"`
 	Condition string  `xml:"condition,attr"`
+	ArrayPath string  `xml:"array_path,attr"` // arrays within each query item to iterate
+	Filter    string  `xml:"filter,attr"`     // JSONPath filter expression items must match
+	Aggregate string  `xml:"aggregate,attr"`  // count, sum, avg, min or max of the items, see envoy_aggregate.go
 	Fields    []Field `xml:"field"`
 	Value     string  `xml:"value"`
 }
@@ -68,9 +148,68 @@ type Transforms struct {
 	Transforms []Transform `xml:"transform"`
 }
 
+// A named conversion of a field's value. It sets one of map, scale,
+// convert, regex, timestamp or chain; one with only a description
+// documents a built-in transform. See envoy_transforms.go.
 type Transform struct {
-	Name        string `xml:"name,attr"`
-	Description string `xml:"description"`
+	Name        string              `xml:"name,attr"`
+	Description string              `xml:"description"`
+	Map         *TransformMap       `xml:"map"`
+	Scale       *TransformScale     `xml:"scale"`
+	Convert     *TransformConvert   `xml:"convert"`
+	Regex       *TransformRegex     `xml:"regex"`
+	Timestamp   *TransformTimestamp `xml:"timestamp"`
+	Chain       string              `xml:"chain"` // transform names applied in order, comma separated
+}
+
+// Lookup of a value's text, e.g. a state string, to a number
+type TransformMap struct {
+	Default string              `xml:"default,attr"` // number for unlisted values; without one they produce no series
+	Entries []TransformMapEntry `xml:"entry"`
+}
+
+type TransformMapEntry struct {
+	Key   string  `xml:"key,attr"`
+	Value float64 `xml:"value,attr"`
+}
+
+// value * factor + offset
+type TransformScale struct {
+	Factor *float64 `xml:"factor,attr"` // default 1
+	Offset float64  `xml:"offset,attr"`
+}
+
+// Conversion between units of the same quantity, e.g. mW to W
+type TransformConvert struct {
+	From string `xml:"from,attr"`
+	To   string `xml:"to,attr"`
+}
+
+// The group named "value", or else the first group, of a regex match
+type TransformRegex struct {
+	Pattern string `xml:"pattern,attr"`
+}
+
+// Parsing of a date and time into a Unix timestamp in seconds
+type TransformTimestamp struct {
+	Layout   string `xml:"layout,attr"`   // Go reference layout, rfc3339, unix or unix_ms
+	Location string `xml:"location,attr"` // zone for layouts without one, default UTC
+}
+
+// Rules rewriting or dropping exposed series, applied in order. The
+// attributes follow Prometheus' metric_relabel_configs.
+type RelabelConfigs struct {
+	Rules []RelabelRule `xml:"rule"`
+}
+
+type RelabelRule struct {
+	Action       string  `xml:"action,attr"`        // replace (default), keep, drop, labelmap, labeldrop, labelkeep or hashmod
+	SourceLabels string  `xml:"source_labels,attr"` // comma separated; __name__ is the metric name
+	Separator    *string `xml:"separator,attr"`     // joins the source label values, default ;
+	Regex        *string `xml:"regex,attr"`         // anchored, default (.*)
+	TargetLabel  string  `xml:"target_label,attr"`
+	Replacement  *string `xml:"replacement,attr"`   // default $1
+	Modulus      uint64  `xml:"modulus,attr"`       // hashmod
 }
 
 type Conditions struct {
@@ -83,20 +222,43 @@ type Condition struct {
 	Check       string `xml:"check"`
 }
 
+// Enlighten/entrez login flow configuration
+type CloudConfig struct {
+	EnlightenURL string `xml:"enlighten_url"` // default https://enlighten.enphaseenergy.com
+	EntrezURL    string `xml:"entrez_url"`    // default https://entrez.enphaseenergy.com
+	Proxy        string `xml:"proxy" secret:"true"` // http://, socks5:// URL or "environment"; may hold credentials
+	Timeout      int    `xml:"timeout"`       // seconds, default 30
+}
+
+// Gateway certificate verification. Without a fingerprint or CA bundle the
+// certificate is pinned on first contact.
+type GatewayTLSConfig struct {
+	Fingerprint string `xml:"fingerprint"` // expected SHA-256 fingerprint
+	CAFile      string `xml:"ca_file"`     // CA bundle that signed the gateway cert
+	Insecure    bool   `xml:"insecure"`    // disable verification entirely
+}
+
+// mDNS discovery of gateways configured without envoy_ip
+type DiscoveryConfig struct {
+	Interval  int    `xml:"interval"`  // seconds between browses, default 60
+	Interface string `xml:"interface"` // network interface to browse on (optional)
+}
+
 // MQTT configuration structure
 type MQTTConfig struct {
-	Enabled         bool   `xml:"enabled,attr"`
-	Broker          string `xml:"broker"`
-	Port            int    `xml:"port"`
-	Username        string `xml:"username"`
-	Password        string `xml:"password"`
-	ClientID        string `xml:"client_id"`
-	TopicPrefix     string `xml:"topic_prefix"`
-	QoS             byte   `xml:"qos"`
-	Retain          bool   `xml:"retain"`
-	TLS             bool   `xml:"tls"`
-	InsecureTLS     bool   `xml:"insecure_tls"`
-	PublishInterval int    `xml:"publish_interval"` // seconds, default 60
+	Enabled         bool           `xml:"enabled,attr"`
+	Broker          string         `xml:"broker"`
+	Port            int            `xml:"port"`
+	Username        string         `xml:"username"`
+	Password        string         `xml:"password" secret:"true"`
+	ClientID        string         `xml:"client_id"`
+	TopicPrefix     string         `xml:"topic_prefix"`
+	QoS             byte           `xml:"qos"`
+	Retain          bool           `xml:"retain"`
+	TLS             bool           `xml:"tls"`
+	InsecureTLS     bool           `xml:"insecure_tls"`
+	PublishInterval int            `xml:"publish_interval"` // seconds, default 60
+	Relabel         RelabelConfigs `xml:"relabel"`          // rules for the published values, see mqttSeries
 }
 
 // Authentication structures
@@ -114,6 +276,17 @@ type TokenResponse struct {
 	ExpiresAt      int64  `json:"expires_at"`
 }
 
+// Claims carried in the Envoy JWT issued by entrez
+type EnvoyTokenClaims struct {
+	Audience    json.RawMessage `json:"aud"`
+	Issuer      string          `json:"iss"`
+	EnphaseUser string          `json:"enphaseUser"` // "owner" or "installer"
+	Username    string          `json:"username"`
+	Serial      string          `json:"serial"`
+	ExpiresAt   int64           `json:"exp"`
+	IssuedAt    int64           `json:"iat"`
+}
+
 // Monitor API structures
 type MonitorData struct {
 	Timestamp          time.Time         `json:"timestamp"`
@@ -177,27 +350,85 @@ type SummaryData struct {
 
 // Query result tracking
 type QueryResult struct {
-	Name      string
-	Success   bool
-	Error     string
-	DataSize  int
-	IsJSON    bool
-	HasData   bool
+	Name        string  `json:"name"`
+	URL         string  `json:"url"`
+	Success     bool    `json:"success"`
+	Error       string  `json:"error,omitempty"`
+	DataSize    int     `json:"data_size"`
+	IsJSON      bool    `json:"is_json"`
+	HasData     bool    `json:"has_data"`
+	StatusCode  int     `json:"status_code"`
+	Duration    float64 `json:"duration_seconds"`
+	Timestamp   int64   `json:"timestamp"`    // last execution
+	LastSuccess int64   `json:"last_success"` // 0 if it never succeeded
+}
+
+// Result of one poll of a gateway endpoint
+type EndpointResult struct {
+	URL       string
+	Data      interface{} // parsed JSON, nil when the poll failed
+	Size       int
 	StatusCode int
+	IsJSON     bool
+	FetchedAt  time.Time
+	Duration  time.Duration
+	Err       error
+}
+
+// Immutable view of a gateway built from the latest poll of each endpoint.
+// Readers never trigger requests to the Envoy.
+type GatewaySnapshot struct {
+	Timestamp time.Time
+	Endpoints map[string]*EndpointResult // by URL template
+	Metrics   []metricSample             // query and calculated metrics
+	Monitor   MonitorData
 }
 
 type EnvoyExporter struct {
 	config            Config
+	gateways          []*Gateway
+	probeGateways     map[string]*probeTarget // /probe targets by auth module and address
+	probeMutex        sync.Mutex
+	mqttPublisher     *MQTTPublisher    // ADD THIS LINE
+	relabel           relabelRules      // applied to every exposed series
+	mqttRelabel       relabelRules      // applied to the MQTT values
+}
+
+// Per-gateway connection, authentication and polling state
+type Gateway struct {
+	name              string
+	stateID           string // distinguishes the gateway's state files in state_dir
+	config            Config // top-level config with this gateway's settings applied
+	collectMutex      sync.Mutex // serializes metric rendering sharing the metric cache
+	address           string     // current Envoy IP, static or discovered
+	addressSource     string
+	addressChanges    int64
+	addressChangedAt  int64
+	addressMutex      sync.RWMutex
+	discover          bool       // follow the address advertised via mDNS
 	token             string
 	tokenExpires      int64
+	tokenSource       string
+	tokenScope        string
+	tokenIssued       int64
+	tokenFileModTime  time.Time
 	tokenMutex        sync.RWMutex
-	httpClient        *http.Client
-	metricCache       map[string]float64
+	refresh           tokenRefreshState
+	session           envoySession
+	cloudClient       *http.Client // Enlighten/entrez login flow
+	gatewayClient     *http.Client // requests to the Envoy on the LAN
+	certVerifier      *gatewayCertVerifier
+	metricCache       map[string]exprVector // series of the last collection, by metric name
+	calculationErrors map[string]string // last error per calculated metric
+	transforms        map[string]transformFunc // built-in and configured, by name
 	cacheMutex        sync.RWMutex
 	queryResults      map[string]QueryResult
 	resultsMutex      sync.RWMutex
-	lastMonitorData   MonitorData
-	monitorMutex      sync.RWMutex
+	snapshot          *GatewaySnapshot // latest poll results, replaced on every update
+	snapshotMutex     sync.RWMutex
+	updateMutex       sync.Mutex // serializes snapshot rebuilds
+	workers           chan struct{} // bounds concurrent requests to the gateway
 	productionTracker *ProductionTracker
-	mqttPublisher     *MQTTPublisher    // ADD THIS LINE
+	stopped           chan struct{} // closed by stop
+	stopOnce          sync.Once
 }
@@ -131,13 +131,15 @@ func (e *EnvoyExporter) serveVersionAPI(w http.ResponseWriter, r *http.Request)
 			"cpu_count":      runtime.NumCPU(),
 		},
 		"config_info": map[string]interface{}{
-			"envoy_ip":         e.config.EnvoyIP,
+			"envoy_ip":         e.primaryEnvoyIP(),
+			"gateways":         e.gatewayNames(),
 			"port":            e.config.Port,
 			"web_dir":         e.config.WebDir,
+			"state_dir":       e.config.StateDir,
 			"queries":         len(e.config.Queries),
 			"calculated_metrics": len(e.config.CalculatedMetrics.Metrics),
 			"mqtt_enabled":    e.config.MQTT.Enabled,
-			"production_tracking": e.productionTracker != nil,
+			"production_tracking": len(e.gateways) > 0,
 		},
 	}
 	
@@ -145,22 +147,23 @@ func (e *EnvoyExporter) serveVersionAPI(w http.ResponseWriter, r *http.Request)
 }
 
 // Add version metrics to Prometheus metrics
-func (e *EnvoyExporter) addVersionMetrics(metrics *strings.Builder) {
+func (e *EnvoyExporter) addVersionMetrics(set *metricSet) {
 	info := GetBuildInfo()
 	
 	// Version info metric
-	metrics.WriteString("# HELP envoy_exporter_build_info Build information\n")
-	metrics.WriteString("# TYPE envoy_exporter_build_info gauge\n")
-	metrics.WriteString(fmt.Sprintf(`envoy_exporter_build_info{version="%s",git_commit="%s",git_branch="%s",go_version="%s",platform="%s"} 1`+"\n",
-		info.Version, info.GitCommit, info.GitBranch, info.GoVersion, info.Platform))
+	set.add("envoy_exporter_build_info", "gauge", "Build information", map[string]string{
+		"version":    info.Version,
+		"git_commit": info.GitCommit,
+		"git_branch": info.GitBranch,
+		"go_version": info.GoVersion,
+		"platform":   info.Platform,
+	}, 1)
 	
 	// Start time metric
-	metrics.WriteString("# HELP envoy_exporter_start_time_seconds Start time of the exporter\n")
-	metrics.WriteString("# TYPE envoy_exporter_start_time_seconds gauge\n")
-	metrics.WriteString(fmt.Sprintf("envoy_exporter_start_time_seconds %d\n", info.StartTime.Unix()))
+	set.add("envoy_exporter_start_time_seconds", "gauge", "Start time of the exporter", nil,
+		float64(info.StartTime.Unix()))
 	
 	// Uptime metric
-	metrics.WriteString("# HELP envoy_exporter_uptime_seconds Uptime of the exporter\n")
-	metrics.WriteString("# TYPE envoy_exporter_uptime_seconds counter\n")
-	metrics.WriteString(fmt.Sprintf("envoy_exporter_uptime_seconds %d\n", int64(time.Since(startTime).Seconds())))
+	set.add("envoy_exporter_uptime_seconds", "counter", "Uptime of the exporter", nil,
+		float64(int64(time.Since(startTime).Seconds())))
 }